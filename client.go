@@ -0,0 +1,203 @@
+package dragonfly2imgproxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// GenerateDragonflyURL returns a signed /media/<b64>.<ext>?sha=<sha> url for
+// jobs, the inverse of what ServeHTTP parses. An empty ext omits the extension.
+func GenerateDragonflyURL(secret string, jobs [][]string, ext string) (string, error) {
+	config := CreateConfig()
+	config.DragonflySecret = secret
+	return config.GenerateDragonflyURL(jobs, ext)
+}
+
+// GenerateDragonflyURL is GenerateDragonflyURL for urls served with this config.
+func (config *Config) GenerateDragonflyURL(jobs [][]string, ext string) (string, error) {
+	if len(ext) > 0 {
+		ext = "." + strings.TrimPrefix(ext, ".")
+	}
+	return config.dragonflyURL(jobs, ext)
+}
+
+// BuildSrcset returns a srcset attribute value with one signed dragonfly url
+// per width, each one resizing baseJobs to that width, e.g.
+// "https://example.com/media/<b64>.jpg?sha=<sha> 400w, ...".
+func BuildSrcset(secret, prefix string, baseJobs [][]string, widths []int) (string, error) {
+	config := CreateConfig()
+	config.DragonflySecret = secret
+	return config.BuildSrcset(prefix, baseJobs, widths)
+}
+
+// BuildSrcset is BuildSrcset for urls served with this config.
+func (config *Config) BuildSrcset(prefix string, baseJobs [][]string, widths []int) (string, error) {
+	if len(widths) == 0 {
+		return "", errors.New("Srcset widths required")
+	}
+	pathPrefix := config.normalize().PathPrefix
+	urlRegex, err := mediaRegex(pathPrefix, false, config.AllowedExtensions)
+	if err != nil {
+		return "", err
+	}
+	prefix = strings.TrimSuffix(prefix, "/")
+	ext := sourceExtension(baseJobs, pathPrefix, urlRegex)
+	candidates := make([]string, 0, len(widths))
+	for _, width := range widths {
+		if width <= 0 {
+			return "", fmt.Errorf("Invalid srcset width: %d", width)
+		}
+		jobs := make([][]string, 0, len(baseJobs)+1)
+		jobs = append(jobs, baseJobs...)
+		jobs = append(jobs, []string{"p", "thumb", strconv.Itoa(width) + "x"})
+		dragonfly_url, err := config.dragonflyURL(jobs, ext)
+		if err != nil {
+			return "", err
+		}
+		candidates = append(candidates, prefix+dragonfly_url+" "+strconv.Itoa(width)+"w")
+	}
+	return strings.Join(candidates, ", "), nil
+}
+
+// Build a signed /media/<b64><ext>?sha=<sha> url, or /media/<b64>/<sha><ext>
+// with ShaInPath, under PathPrefix, ext includes the leading dot
+func (config *Config) dragonflyURL(jobs [][]string, ext string) (string, error) {
+	jobBytes, err := json.Marshal(jobs)
+	if err != nil {
+		return "", err
+	}
+	normalized := config.normalize() // fills in defaults like New
+	sha := calculateSHA(normalized.DragonflySecret, jobs, normalized.HashAlgorithm, normalized.SignatureLength)
+	if normalized.ShaInPath {
+		return normalized.PathPrefix + base64.RawURLEncoding.EncodeToString(jobBytes) + "/" + sha + ext, nil
+	}
+	return normalized.PathPrefix + base64.RawURLEncoding.EncodeToString(jobBytes) + ext + "?sha=" + sha, nil
+}
+
+// Extension of the fetched file, empty when there is no fetch job or no
+// extension urlRegex strips from media urls under pathPrefix
+func sourceExtension(jobs [][]string, pathPrefix string, urlRegex *regexp.Regexp) string {
+	for _, job := range jobs {
+		if len(job) < 2 || job[0] != "f" {
+			continue
+		}
+		ext := path.Ext(job[1])
+		if match := urlRegex.FindStringSubmatch(pathPrefix + "x" + ext); match == nil || match[2] != ext {
+			return ""
+		}
+		return ext
+	}
+	return ""
+}
+
+// CalculateSHA returns the dragonfly signature of jobs for secret.
+func CalculateSHA(secret string, jobs [][]string) string {
+	return calculateSHA(secret, jobs, defaultHashAlgorithm, defaultSignatureLength)
+}
+
+// GenerateImgproxyURL returns the imgproxy path for jobs fetched from prefix,
+// using the default config.
+func GenerateImgproxyURL(prefix string, jobs [][]string) (string, error) {
+	config := CreateConfig()
+	config.URLPrefix = prefix
+	return generate_imgproxy_url(config, jobs, requestOptions{})
+}
+
+// GenerateBatch returns the imgproxy path for each job list fetched from
+// prefix, as served with the default config and secret. It fails on the first
+// invalid job list.
+func GenerateBatch(secret, prefix string, jobLists [][][]string) ([]string, error) {
+	config := CreateConfig()
+	config.DragonflySecret = secret
+	config.URLPrefix = prefix
+	return config.GenerateBatch(jobLists)
+}
+
+// GenerateBatch is GenerateBatch for job lists served with this config, the
+// config, imgproxy signing key and url buffer are shared across the batch.
+func (config *Config) GenerateBatch(jobLists [][][]string) ([]string, error) {
+	if len(config.DragonflySecret) == 0 {
+		return nil, errors.New("DragonflySecret required")
+	}
+	normalized := config.normalize() // fills in defaults like New
+	if err := validatePrefix("URLPrefix", normalized.URLPrefix, normalized.SourceType); err != nil {
+		return nil, err
+	}
+	signer, err := newImgproxySigner(normalized) // signs like the handler, one key for the batch
+	if err != nil {
+		return nil, err
+	}
+	var buffer bytes.Buffer // unlike a strings.Builder it keeps its memory on Reset
+	imgproxy_urls := make([]string, 0, len(jobLists))
+	for i, jobs := range jobLists {
+		imgproxy_url, err := writeImgproxyURL(&buffer, normalized, signer, jobs, requestOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("Job list %d: %w", i, err)
+		}
+		imgproxy_urls = append(imgproxy_urls, imgproxy_url)
+	}
+	return imgproxy_urls, nil
+}
+
+// SignatureVector is a dragonfly signing example: Jobs signed with Secret
+// give SHA, the first 16 hex characters of the HMAC-SHA256 digest.
+type SignatureVector struct {
+	Name   string
+	Secret string
+	Jobs   [][]string
+	SHA    string
+}
+
+// SignatureVectors are signatures computed independently from the dragonfly
+// message scheme, every job element concatenated in job order, for checking
+// signers against this middleware.
+var SignatureVectors = []SignatureVector{
+	{
+		Name:   "fetch",
+		Secret: "secret",
+		Jobs:   [][]string{{"f", "uploads/2024/photo.jpg"}},
+		SHA:    "db914df7e8fe06f6",
+	},
+	{
+		Name:   "fetch and thumb",
+		Secret: "secret",
+		Jobs:   [][]string{{"f", "uploads/2024/photo.jpg"}, {"p", "thumb", "400x300#"}},
+		SHA:    "4719647341a10d50",
+	},
+	{
+		Name:   "thumb before fetch",
+		Secret: "secret",
+		Jobs:   [][]string{{"p", "thumb", "400x300#"}, {"f", "uploads/2024/photo.jpg"}},
+		SHA:    "677b96265d3d3eb2",
+	},
+	{
+		Name:   "fetch, thumb and encode",
+		Secret: "another secret",
+		Jobs:   [][]string{{"f", "photo.png"}, {"p", "thumb", "200x"}, {"p", "encode", "webp"}},
+		SHA:    "a9838092335b32e4",
+	},
+	{
+		Name:   "fetch with prefix key",
+		Secret: "secret",
+		Jobs:   [][]string{{"f", "cdn", "photo.jpg"}},
+		SHA:    "21de4b1e574026b7",
+	},
+}
+
+// VerifyCompatibility checks CalculateSHA against SignatureVectors, returning
+// the first mismatch.
+func VerifyCompatibility() error {
+	for _, vector := range SignatureVectors {
+		if sha := CalculateSHA(vector.Secret, vector.Jobs); sha != vector.SHA {
+			return fmt.Errorf("Signature vector %q: got %s, want %s", vector.Name, sha, vector.SHA)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,306 @@
+package dragonfly2imgproxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestBuildSrcset(t *testing.T) {
+	baseJobs := [][]string{{"f", "products/lamp.webp"}, {"p", "trim", "8"}}
+	srcset, err := BuildSrcset(testSecret, "https://shop.example.com/", baseJobs, []int{320, 640, 1280})
+	if err != nil {
+		t.Fatal(err)
+	}
+	candidates := strings.Split(srcset, ", ")
+	if len(candidates) != 3 {
+		t.Fatalf("srcset %q, want 3 candidates", srcset)
+	}
+	handler, next := newTestHandler(t, nil)
+	for i, width := range []string{"320", "640", "1280"} {
+		fields := strings.Fields(candidates[i])
+		if len(fields) != 2 || fields[1] != width+"w" {
+			t.Fatalf("candidate %q, want a %sw descriptor", candidates[i], width)
+		}
+		jobs := append(baseJobs[:2:2], []string{"p", "thumb", width + "x"})
+		if want := "https://shop.example.com" + signedURL(t, testSecret, jobs, ".webp"); fields[0] != want {
+			t.Errorf("url %s, want %s", fields[0], want)
+		}
+		rw := serve(handler, strings.TrimPrefix(fields[0], "https://shop.example.com"), nil)
+		if rw.Code != http.StatusOK {
+			t.Fatalf("status %d, body %q", rw.Code, rw.Body.String())
+		}
+		if want := "/insecure/trim:8/rs:fit:" + width + ":0/ar:1/plain/https://images.example.com/products/lamp.webp"; next.req.URL.Path != want {
+			t.Errorf("forwarded %s, want %s", next.req.URL.Path, want)
+		}
+	}
+
+	for _, widths := range [][]int{nil, {400, 0}, {-1}} {
+		if _, err := BuildSrcset(testSecret, "", baseJobs, widths); err == nil {
+			t.Errorf("widths %v accepted", widths)
+		}
+	}
+}
+
+func TestConfigBuildSrcset(t *testing.T) {
+	config := testConfig()
+	config.DragonflySecret = "rotated"
+	got, err := config.BuildSrcset("", [][]string{{"f", "notes/readme"}}, []int{500})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := signedURL(t, "rotated", [][]string{{"f", "notes/readme"}, {"p", "thumb", "500x"}}, "") + " 500w"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestSourceExtension(t *testing.T) {
+	tests := map[string][][]string{
+		".png":  {{"p", "thumb", "10x"}, {"f", "a/b.png"}},
+		".JPEG": {{"f", "scans/IMG.JPEG"}},
+		"":      {{"f", "archive/report.pdf"}},
+	}
+	urlRegex, err := mediaRegex(defaultPathPrefix, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for want, jobs := range tests {
+		if got := sourceExtension(jobs, defaultPathPrefix, urlRegex); got != want {
+			t.Errorf("sourceExtension(%v) = %q, want %q", jobs, got, want)
+		}
+	}
+	if got := sourceExtension([][]string{{"f", "dir.v2/file"}}, defaultPathPrefix, urlRegex); got != "" {
+		t.Errorf("extension of a file without one: %q", got)
+	}
+}
+
+func TestGenerateDragonflyURL(t *testing.T) {
+	jobs := [][]string{{"f", "listings/42/kitchen.jpg"}, {"p", "thumb", "480x320#"}}
+	handler, next := newTestHandler(t, nil)
+	for _, ext := range []string{"jpg", ".jpg", ""} {
+		dragonfly_url, err := GenerateDragonflyURL(testSecret, jobs, ext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := signedURL(t, testSecret, jobs, ".jpg")
+		if ext == "" {
+			want = signedURL(t, testSecret, jobs, "")
+		}
+		if dragonfly_url != want {
+			t.Errorf("ext %q: got %s, want %s", ext, dragonfly_url, want)
+		}
+
+		next.called = false
+		rw := serve(handler, dragonfly_url, nil)
+		if rw.Code != http.StatusOK || !next.called {
+			t.Fatalf("ext %q: status %d, body %q", ext, rw.Code, rw.Body.String())
+		}
+		if want := "/insecure/rs:fill:480:320:g:ce/ar:1/plain/https://images.example.com/listings/42/kitchen.jpg"; next.req.URL.Path != want {
+			t.Errorf("ext %q: forwarded %s, want %s", ext, next.req.URL.Path, want)
+		}
+	}
+
+	config := testConfig()
+	config.DragonflySecret = "per-site"
+	dragonfly_url, err := config.GenerateDragonflyURL(jobs, "jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rw := serve(handler, dragonfly_url, nil); rw.Code == http.StatusOK {
+		t.Error("url signed with another config's secret accepted")
+	}
+}
+
+func TestExportedWrappers(t *testing.T) {
+	jobLists := [][][]string{
+		{{"f", "invoices/2023/march.png"}},
+		{{"f", "invoices/2023/march.png"}, {"p", "trim", "12", "ffffff"}, {"p", "thumb", "250x250#"}},
+		{{"f", "stickers/wave.gif"}, {"p", "thumb", "72x72"}},
+		{{"f", "invoices/2023/march.png"}, {"p", "trim", "-4"}},
+	}
+	config := CreateConfig() // the wrappers use the default options
+	config.URLPrefix = testPrefix
+	for _, jobs := range jobLists {
+		if got, want := CalculateSHA("exported", jobs), calculateSHA("exported", jobs, defaultHashAlgorithm, defaultSignatureLength); got != want {
+			t.Errorf("CalculateSHA(%q) = %s, want %s", jobs, got, want)
+		}
+		want, wantErr := generate_imgproxy_url(config, jobs, requestOptions{})
+		got, err := GenerateImgproxyURL(testPrefix, jobs)
+		if got != want || (err != nil) != (wantErr != nil) {
+			t.Errorf("GenerateImgproxyURL(%q) = %q, %v, want %q, %v", jobs, got, err, want, wantErr)
+		}
+	}
+	if _, err := GenerateImgproxyURL(testPrefix, jobLists[3]); err == nil {
+		t.Error("GenerateImgproxyURL accepted a negative trim threshold")
+	}
+}
+
+func TestGenerateDragonflyURLSignatureLength(t *testing.T) {
+	jobs := [][]string{{"f", "maps/route-12.png"}}
+	config := testConfig()
+	config.SignatureLength = 40
+	dragonfly_url, err := config.GenerateDragonflyURL(jobs, "png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sha := dragonfly_url[strings.Index(dragonfly_url, "?sha=")+5:]; sha != calculateSHA(testSecret, jobs, defaultHashAlgorithm, 40) {
+		t.Errorf("sha %q, want 40 characters", sha)
+	}
+	handler, next := newTestHandler(t, func(config *Config) { config.SignatureLength = 40 })
+	if rw := serve(handler, dragonfly_url, nil); rw.Code != http.StatusOK || !next.called {
+		t.Errorf("status %d, body %q", rw.Code, rw.Body.String())
+	}
+}
+
+func TestBuildSrcsetShaInPath(t *testing.T) {
+	config := testConfig()
+	config.ShaInPath = true
+	srcset, err := config.BuildSrcset("", [][]string{{"f", "blog/2024/cover.webp"}}, []int{600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs := [][]string{{"f", "blog/2024/cover.webp"}, {"p", "thumb", "600x"}}
+	if want := "/" + CalculateSHA(testSecret, jobs) + ".webp 600w"; !strings.HasSuffix(srcset, want) || strings.Contains(srcset, "?") {
+		t.Fatalf("srcset %q, want the sha in the path", srcset)
+	}
+	handler, next := newTestHandler(t, func(config *Config) { config.ShaInPath = true })
+	if rw := serve(handler, strings.Fields(srcset)[0], nil); rw.Code != http.StatusOK || !next.called {
+		t.Errorf("status %d, body %q", rw.Code, rw.Body.String())
+	}
+}
+
+// job lists for a product gallery, one per variant and size
+func galleryJobLists(n int) [][][]string {
+	jobLists := make([][][]string, 0, n)
+	for i := 0; i < n; i++ {
+		variant := "catalog/sneakers/variant-" + strconv.Itoa(i%7) + ".png"
+		jobLists = append(jobLists, [][]string{{"f", variant}, {"p", "thumb", strconv.Itoa(120+10*i) + "x" + strconv.Itoa(90+i) + "#"}, {"p", "encode", "webp"}})
+	}
+	return jobLists
+}
+
+func TestGenerateBatch(t *testing.T) {
+	jobLists := append(galleryJobLists(12), [][]string{{"f", "catalog/sneakers/360.gif"}, {"p", "thumb", "200x"}})
+	imgproxy_urls, err := GenerateBatch(testSecret, testPrefix, jobLists)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imgproxy_urls) != len(jobLists) {
+		t.Fatalf("got %d urls for %d job lists", len(imgproxy_urls), len(jobLists))
+	}
+	// each path is the one the default handler forwards for the signed dragonfly url
+	handler, next := newTestHandler(t, func(config *Config) { config.StripMetadata = true })
+	for i, jobs := range jobLists {
+		rw := serve(handler, signedURL(t, testSecret, jobs, sourceExtension(jobs, defaultPathPrefix, mustMediaRegex(t))), nil)
+		if rw.Code != http.StatusOK {
+			t.Fatalf("job list %d: status %d, body %q", i, rw.Code, rw.Body.String())
+		}
+		if forwarded := next.req.URL.EscapedPath(); imgproxy_urls[i] != forwarded {
+			t.Errorf("job list %d: got %s, handler forwarded %s", i, imgproxy_urls[i], forwarded)
+		}
+	}
+
+	config := testConfig()
+	config.SourceURLMode = "base64"
+	encoded, err := config.GenerateBatch(jobLists[:2])
+	if err != nil || len(encoded) != 2 || encoded[0] == imgproxy_urls[0] || strings.Contains(encoded[1], "/plain/") {
+		t.Errorf("config batch %q, %v, want base64 sources", encoded, err)
+	}
+
+	_, err = GenerateBatch(testSecret, testPrefix, append(jobLists[:3:3], [][]string{{"f", "catalog/x.png"}, {"p", "pixelate", "-1"}}))
+	if err == nil || !strings.HasPrefix(err.Error(), "Job list 3:") {
+		t.Errorf("invalid job list error %v, want one naming job list 3", err)
+	}
+	for name, args := range map[string][2]string{"no secret": {"", testPrefix}, "no prefix": {testSecret, ""}, "relative prefix": {testSecret, "images/"}} {
+		if _, err := GenerateBatch(args[0], args[1], jobLists); err == nil {
+			t.Errorf("%s: batch generated", name)
+		}
+	}
+}
+
+func mustMediaRegex(t testing.TB) *regexp.Regexp {
+	t.Helper()
+	urlRegex, err := mediaRegex(defaultPathPrefix, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return urlRegex
+}
+
+func BenchmarkGenerateBatch(b *testing.B) {
+	jobLists := galleryJobLists(500)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := GenerateBatch(testSecret, testPrefix, jobLists); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSignedGenerateBatch(b *testing.B) {
+	config := CreateConfig()
+	config.DragonflySecret = testSecret
+	config.URLPrefix = testPrefix
+	config.ImgproxyKey = "943b421c9eb07c830af81030552c86009268de4e532ba2ee2eab8247c6da0881"
+	config.ImgproxySalt = "520f986b998545b4785e0defbc4f3c1203f22de2374a3d53cb7a7fe9fea309c5"
+	jobLists := galleryJobLists(500)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := config.GenerateBatch(jobLists); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// the same job lists one GenerateImgproxyURL call at a time
+func BenchmarkGenerateImgproxyURLEach(b *testing.B) {
+	jobLists := galleryJobLists(500)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, jobs := range jobLists {
+			if _, err := GenerateImgproxyURL(testPrefix, jobs); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestVerifyCompatibility(t *testing.T) {
+	if err := VerifyCompatibility(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the vectors stand on their own, a plain HMAC over the concatenated
+	// elements, so a change to the message scheme shows up here
+	for _, vector := range SignatureVectors {
+		message := ""
+		for _, job := range vector.Jobs {
+			message += strings.Join(job, "")
+		}
+		mac := hmac.New(sha256.New, []byte(vector.Secret))
+		mac.Write([]byte(message))
+		if sha := hex.EncodeToString(mac.Sum(nil))[:16]; sha != vector.SHA {
+			t.Errorf("%s: vector %s, HMAC of %q is %s", vector.Name, vector.SHA, message, sha)
+		}
+	}
+
+	// order matters, swapping the jobs of a vector changes the signature
+	fetchThumb, thumbFetch := SignatureVectors[1], SignatureVectors[2]
+	if fetchThumb.SHA == thumbFetch.SHA || CalculateSHA(fetchThumb.Secret, thumbFetch.Jobs) != thumbFetch.SHA {
+		t.Errorf("job order does not change the signature")
+	}
+
+	// a broken vector is reported by name
+	saved := SignatureVectors
+	defer func() { SignatureVectors = saved }()
+	SignatureVectors = append([]SignatureVector{}, saved...)
+	SignatureVectors[3].Jobs = [][]string{{"f", "photo.png"}, {"p", "encode", "webp"}, {"p", "thumb", "200x"}}
+	if err := VerifyCompatibility(); err == nil || !strings.Contains(err.Error(), `"fetch, thumb and encode"`) {
+		t.Errorf("reordered vector error %v", err)
+	}
+}
@@ -2,83 +2,680 @@
 package dragonfly2imgproxy
 
 import (
+	"bytes"
 	"context"
 	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/sha512"
+	"encoding"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"log"
+	"math"
 	"net/http"
 	"net/url"
-	"path/filepath"
+	"path"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Config configures the middleware.
 type Config struct {
 	DragonflySecret string `json:"dragonflySecret" yaml:"dragonflySecret" toml:"dragonflySecret"`
 	URLPrefix       string `json:"urlPrefix" yaml:"urlPrefix" toml:"urlPrefix"`
+	// accept a single job like ["f","foo.jpg"] not wrapped in an outer array
+	AllowSingleJobShape bool `json:"allowSingleJobShape" yaml:"allowSingleJobShape" toml:"allowSingleJobShape"`
+	// Timing-Allow-Origin header value for image responses, unset by default
+	TimingAllowOrigin string `json:"timingAllowOrigin" yaml:"timingAllowOrigin" toml:"timingAllowOrigin"`
+	// force output format for request paths matching a regex, e.g. {"^/thumbs/": "webp"}
+	FormatByPathRegex map[string]string `json:"formatByPathRegex" yaml:"formatByPathRegex" toml:"formatByPathRegex"`
+	// how the source url is passed to imgproxy: "plain" (/plain/<url>) or
+	// "base64" (/<base64url>.<ext>, the form recommended for signed urls, its
+	// extension is the source format or a forced output format, replacing f:)
+	SourceURLMode string `json:"sourceURLMode" yaml:"sourceURLMode" toml:"sourceURLMode"`
+	// imgproxy source type: "http" needs an absolute URLPrefix, "local" takes a
+	// URLPrefix path like /images/ under imgproxy's local filesystem root
+	SourceType string `json:"sourceType" yaml:"sourceType" toml:"sourceType"`
+	// extra source prefixes selected by key with a ["f", key, path] fetch job
+	Prefixes map[string]string `json:"prefixes" yaml:"prefixes" toml:"prefixes"`
+	// imgproxy preset applied to every url, empty for none
+	DefaultPreset string `json:"defaultPreset" yaml:"defaultPreset" toml:"defaultPreset"`
+	// count requests, failures and url generation latency, read them with Collector
+	EnableMetrics bool `json:"enableMetrics" yaml:"enableMetrics" toml:"enableMetrics"`
+	// map the "^" geometry to imgproxy min-width/min-height instead of a fill
+	CaretAsMinDimensions bool `json:"caretAsMinDimensions" yaml:"caretAsMinDimensions" toml:"caretAsMinDimensions"`
+	// keep .avif sources as avif like gif sources, instead of Accept negotiation
+	ForceAvifFormat bool `json:"forceAvifFormat" yaml:"forceAvifFormat" toml:"forceAvifFormat"`
+	// require a signed unix timestamp exp query parameter, signed as an extra
+	// ["e", exp] job, and reject urls past it or expiring more than
+	// ExpirySeconds from now, 0 disables expiry
+	ExpirySeconds int `json:"expirySeconds" yaml:"expirySeconds" toml:"expirySeconds"`
+	// number of hex characters of the HMAC digest used as sha, default 16,
+	// at most the digest length (64 for sha256)
+	SignatureLength int `json:"signatureLength" yaml:"signatureLength" toml:"signatureLength"`
+	// HMAC hash used for sha: sha1, sha256 (default) or sha512
+	HashAlgorithm string `json:"hashAlgorithm" yaml:"hashAlgorithm" toml:"hashAlgorithm"`
+	// read sha from the path, /media/<b64>/<sha>.jpg, instead of the query string
+	ShaInPath bool `json:"shaInPath" yaml:"shaInPath" toml:"shaInPath"`
+	// query parameters forwarded to imgproxy, e.g. cachebust, the ones read by
+	// this middleware (sha, convert, ...) are never forwarded
+	PassthroughParams []string `json:"passthroughParams" yaml:"passthroughParams" toml:"passthroughParams"`
+	// path prefix answering with the decoded jobs and generated url as JSON
+	// instead of forwarding, e.g. /_debug for /_debug/media/<b64>.jpg?sha=<sha>
+	DebugEndpoint string `json:"debugEndpoint" yaml:"debugEndpoint" toml:"debugEndpoint"`
+	// let the default fit geometry (no operator) enlarge small images, when
+	// false they are only enlarged with the "<" operator
+	AllowEnlarge bool `json:"allowEnlarge" yaml:"allowEnlarge" toml:"allowEnlarge"`
+	// timeout for the next handler as a duration like "10s", empty for none
+	ProcessTimeout string `json:"processTimeout" yaml:"processTimeout" toml:"processTimeout"`
+	// imgproxy per-format quality (fq) for jpeg and webp output, 0 to 100,
+	// 0 leaves the imgproxy default
+	JpegQuality int `json:"jpegQuality" yaml:"jpegQuality" toml:"jpegQuality"`
+	WebpQuality int `json:"webpQuality" yaml:"webpQuality" toml:"webpQuality"`
+	// fetch paths must start with one of these, e.g. public/, empty allows all
+	AllowedPathPrefixes []string `json:"allowedPathPrefixes" yaml:"allowedPathPrefixes" toml:"allowedPathPrefixes"`
+	// strip EXIF and other metadata from output images (sm:1)
+	StripMetadata bool `json:"stripMetadata" yaml:"stripMetadata" toml:"stripMetadata"`
+	// rotate images by their EXIF orientation (ar:1), imgproxy applies it before
+	// any rotate job, false emits ar:0 as imgproxy auto-rotates by default
+	AutoRotate bool `json:"autoRotate" yaml:"autoRotate" toml:"autoRotate"`
+	// largest thumb width and height accepted, 0 for no limit
+	MaxWidth  int `json:"maxWidth" yaml:"maxWidth" toml:"maxWidth"`
+	MaxHeight int `json:"maxHeight" yaml:"maxHeight" toml:"maxHeight"`
+	// imgproxy gravity for fill resizes: no, so, ea, we, noea, nowe, soea, sowe,
+	// ce or sm
+	Gravity string `json:"gravity" yaml:"gravity" toml:"gravity"`
+	// map the "!" geometry to a fill with Gravity instead of rs:force, which
+	// ignores gravity and distorts the aspect ratio
+	ForceGeometryAsFill bool `json:"forceGeometryAsFill" yaml:"forceGeometryAsFill" toml:"forceGeometryAsFill"`
+	// paths forwarded to next untouched, e.g. /healthz, also matching sub paths
+	SkipPaths []string `json:"skipPaths" yaml:"skipPaths" toml:"skipPaths"`
+	// forward requests which are not dragonfly urls to next untouched instead
+	// of failing them
+	PassthroughUnmatched bool `json:"passthroughUnmatched" yaml:"passthroughUnmatched" toml:"passthroughUnmatched"`
+	// echo the decoded jobs as JSON in an X-Dragonfly-Jobs response header
+	DebugHeaders bool `json:"debugHeaders" yaml:"debugHeaders" toml:"debugHeaders"`
+	// longest generated imgproxy path forwarded, longer ones fail with 414,
+	// 0 for no limit
+	MaxURLLength int `json:"maxURLLength" yaml:"maxURLLength" toml:"maxURLLength"`
+	// largest decoded jobs JSON accepted, larger payloads fail with 400,
+	// 0 for no limit
+	MaxJobBytes int `json:"maxJobBytes" yaml:"maxJobBytes" toml:"maxJobBytes"`
+	// Accept header sent to imgproxy regardless of the client, e.g. image/webp,
+	// convert=false still clears it and convert=auto keeps the client Accept
+	ForceAccept string `json:"forceAccept" yaml:"forceAccept" toml:"forceAccept"`
+	// per tenant dragonfly secrets selected by the tenant query parameter,
+	// requests without a tenant are verified with DragonflySecret
+	Secrets map[string]string `json:"secrets" yaml:"secrets" toml:"secrets"`
+	// older dragonfly secrets still accepted for requests without a tenant,
+	// to rotate DragonflySecret without breaking urls signed with the old one
+	AdditionalSecrets []string `json:"additionalSecrets" yaml:"additionalSecrets" toml:"additionalSecrets"`
+	// media url extensions stripped before decoding the jobs, e.g. .bmp,
+	// empty for .gif, .png, .jpeg, .jpg, .webp, .avif and .svg
+	AllowedExtensions []string `json:"allowedExtensions" yaml:"allowedExtensions" toml:"allowedExtensions"`
+	// imgproxy resizing algorithm (ra) for resized images: nearest, linear,
+	// cubic, lanczos2 or lanczos3, empty leaves the imgproxy default
+	ResizingAlgorithm string `json:"resizingAlgorithm" yaml:"resizingAlgorithm" toml:"resizingAlgorithm"`
+	// answer with a 302 redirect to ImgproxyBaseURL plus the generated path
+	// instead of forwarding to next
+	RedirectMode bool `json:"redirectMode" yaml:"redirectMode" toml:"redirectMode"`
+	// imgproxy scheme and host, e.g. https://imgproxy.example.com
+	ImgproxyBaseURL string `json:"imgproxyBaseURL" yaml:"imgproxyBaseURL" toml:"imgproxyBaseURL"`
+	// Cache-Control for successful image responses, e.g. public, max-age=31536000,
+	// only set when imgproxy sent none unless CacheControlOverride
+	CacheControl string `json:"cacheControl" yaml:"cacheControl" toml:"cacheControl"`
+	// replace the Cache-Control sent by imgproxy with CacheControl
+	CacheControlOverride bool `json:"cacheControlOverride" yaml:"cacheControlOverride" toml:"cacheControlOverride"`
+	// let imgproxy use the thumbnail embedded in HEIF/AVIF sources (eth:1)
+	UseEmbeddedThumbnail bool `json:"useEmbeddedThumbnail" yaml:"useEmbeddedThumbnail" toml:"useEmbeddedThumbnail"`
+	// force avif output (f:avif) when the client Accept lists image/avif, unless
+	// a format is requested, convert is false or true or the source is a gif
+	// or svg, which keep their own format
+	PreferAvif bool `json:"preferAvif" yaml:"preferAvif" toml:"preferAvif"`
+	// error response body: "text" or "json", {"error": "...", "code": "SHA_MISMATCH"}
+	ErrorFormat string `json:"errorFormat" yaml:"errorFormat" toml:"errorFormat"`
+	// source formats imgproxy returns unprocessed (skp), e.g. svg and gif,
+	// kept as output format (f:gif) as imgproxy only skips without conversion
+	SkipProcessingFormats []string `json:"skipProcessingFormats" yaml:"skipProcessingFormats" toml:"skipProcessingFormats"`
+	// take the imgproxy dpr of resized images from the Sec-CH-DPR client hint,
+	// before the dpr query parameter
+	UseClientHints bool `json:"useClientHints" yaml:"useClientHints" toml:"useClientHints"`
+	// return the original bytes through imgproxy raw mode (raw:1) for fetch-only
+	// jobs without a requested format, maxbytes or page
+	PassOriginalWhenNoProcessing bool `json:"passOriginalWhenNoProcessing" yaml:"passOriginalWhenNoProcessing" toml:"passOriginalWhenNoProcessing"`
+	// path prefix of dragonfly urls, default /media/
+	PathPrefix string `json:"pathPrefix" yaml:"pathPrefix" toml:"pathPrefix"`
+	// status for urls without a sha, default 400, e.g. 404 to hide the endpoint
+	MissingShaStatus int `json:"missingShaStatus" yaml:"missingShaStatus" toml:"missingShaStatus"`
+	// request header carrying a request id, e.g. X-Request-ID, prefixed to every
+	// log line of the request and generated when missing, empty disables it
+	RequestIDHeader string `json:"requestIDHeader" yaml:"requestIDHeader" toml:"requestIDHeader"`
+	// rewrite to the absolute ImgproxyBaseURL plus the generated path, setting
+	// the request scheme and host too, instead of only the path
+	AbsoluteRewrite bool `json:"absoluteRewrite" yaml:"absoluteRewrite" toml:"absoluteRewrite"`
+	// imgproxy IMGPROXY_KEY and IMGPROXY_SALT as hex, when both are set urls are
+	// signed instead of using /insecure
+	ImgproxyKey  string `json:"imgproxyKey" yaml:"imgproxyKey" toml:"imgproxyKey"`
+	ImgproxySalt string `json:"imgproxySalt" yaml:"imgproxySalt" toml:"imgproxySalt"`
+	// reject fetch jobs without an image file extension with 400 before
+	// forwarding, e.g. .pdf or .zip
+	ImageOnly bool `json:"imageOnly" yaml:"imageOnly" toml:"imageOnly"`
+	// thumb geometry applied to jobs without any process job, e.g. 2000x2000>,
+	// not part of the signature
+	DefaultResize string `json:"defaultResize" yaml:"defaultResize" toml:"defaultResize"`
+	// also drop the client Accept-Encoding with convert=false, which is kept by
+	// default
+	StripAcceptEncoding bool `json:"stripAcceptEncoding" yaml:"stripAcceptEncoding" toml:"stripAcceptEncoding"`
 }
 
 // CreateConfig returns a config instance.
 func CreateConfig() *Config {
 	return &Config{
-		DragonflySecret: "",
-		URLPrefix:       "",
+		DragonflySecret:              "",
+		URLPrefix:                    "",
+		AllowSingleJobShape:          false,
+		TimingAllowOrigin:            "",
+		FormatByPathRegex:            map[string]string{},
+		SourceURLMode:                "plain",
+		SourceType:                   "http",
+		Prefixes:                     map[string]string{},
+		DefaultPreset:                "",
+		EnableMetrics:                false,
+		CaretAsMinDimensions:         false,
+		ForceAvifFormat:              false,
+		ExpirySeconds:                0,
+		SignatureLength:              defaultSignatureLength,
+		HashAlgorithm:                defaultHashAlgorithm,
+		ShaInPath:                    false,
+		PassthroughParams:            []string{},
+		DebugEndpoint:                "",
+		AllowEnlarge:                 true,
+		ProcessTimeout:               "",
+		JpegQuality:                  0,
+		WebpQuality:                  0,
+		AllowedPathPrefixes:          []string{},
+		StripMetadata:                true,
+		AutoRotate:                   true,
+		MaxWidth:                     0,
+		MaxHeight:                    0,
+		Gravity:                      "ce",
+		ForceGeometryAsFill:          false,
+		SkipPaths:                    []string{},
+		PassthroughUnmatched:         false,
+		DebugHeaders:                 false,
+		MaxURLLength:                 0,
+		MaxJobBytes:                  0,
+		ForceAccept:                  "",
+		Secrets:                      map[string]string{},
+		AdditionalSecrets:            []string{},
+		AllowedExtensions:            []string{},
+		ResizingAlgorithm:            "",
+		RedirectMode:                 false,
+		ImgproxyBaseURL:              "",
+		CacheControl:                 "",
+		CacheControlOverride:         false,
+		UseEmbeddedThumbnail:         false,
+		PreferAvif:                   false,
+		ErrorFormat:                  "text",
+		SkipProcessingFormats:        []string{},
+		UseClientHints:               false,
+		PassOriginalWhenNoProcessing: false,
+		PathPrefix:                   defaultPathPrefix,
+		MissingShaStatus:             http.StatusBadRequest,
+		RequestIDHeader:              "",
+		AbsoluteRewrite:              false,
+		ImgproxyKey:                  "",
+		ImgproxySalt:                 "",
+		ImageOnly:                    false,
+		DefaultResize:                "",
+		StripAcceptEncoding:          false,
 	}
 }
 
+// largest trim threshold accepted, a difference of 8-bit channel values
+const maxTrimThreshold = 255
+
+// largest zoom factor accepted, whatever MaxWidth and MaxHeight are
+const maxZoom = 10
+
+// largest contrast and saturation factor accepted
+const maxAdjustmentFactor = 10
+
+// imgproxy trim color, hex RRGGBB
+var trimColorRegex = regexp.MustCompile(`^[0-9a-fA-F]{6}$`)
+
 type Dragonfly2imgproxy struct {
-	name   string
-	config *Config
-	next   http.Handler
+	name           string
+	config         *Config
+	next           http.Handler
+	formatRoutes   []formatRoute
+	metrics        *metrics
+	processTimeout time.Duration // 0 for none
+	urlRegex       *regexp.Regexp
+	hmacKeys       map[string]*hmacKey // HMAC key states by accepted secret
+	imgproxyBase   *url.URL            // parsed ImgproxyBaseURL, nil unless needed
+	signer         *imgproxySigner     // nil for /insecure urls
+}
+
+// per-request imgproxy options, these are not part of the signed jobs
+type requestOptions struct {
+	format   string  // forced output format, empty leaves it to Accept negotiation
+	avif     bool    // PreferAvif and the client accepts avif
+	extend   bool    // pad fit resizes up to the requested size
+	maxBytes int     // output size limit, 0 for none
+	focus    string  // focus point x:y for fill gravity, empty for Gravity
+	dpr      float64 // device pixel ratio of resizes, 0 for none
+	filename string  // Content-Disposition filename, empty for imgproxy's
+	page     string  // page of multi-page sources, empty for the first
+}
+
+// DebugEndpoint response body
+type debugResponse struct {
+	Jobs [][]string `json:"jobs"`
+	URL  string     `json:"url"`
+}
+
+// ErrorFormat json response body
+type errorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+type formatRoute struct {
+	regex  *regexp.Regexp
+	format string
+}
+
+// dragonfly signs urls with the first 16 hex characters of a HMAC-SHA256 digest
+const (
+	defaultSignatureLength = 16
+	defaultHashAlgorithm   = "sha256"
+)
+
+// dragonfly url path prefix without PathPrefix
+const defaultPathPrefix = "/media/"
+
+// largest thumb dimension accepted, whatever MaxWidth and MaxHeight are
+const maxDimension = 65535
+
+// largest device pixel ratio accepted from dpr or Sec-CH-DPR
+const maxDPR = 8
+
+// HMAC hash constructors by HashAlgorithm
+var hashAlgorithms = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// media url extensions recognized without AllowedExtensions
+var defaultExtensions = []string{".gif", ".png", ".jpeg", ".jpg", ".webp", ".avif", ".svg"}
+
+// media url extension
+var extensionRegex = regexp.MustCompile(`^\.[a-zA-Z0-9]+$`)
+
+// dragonfly thumb geometry, WxH with an optional operator and fill offsets
+var thumbRegex = regexp.MustCompile(`^(|\d+)x(|\d+)(|>|<|#|!|\^)(?:([+-]\d+)([+-]\d+))?$`)
+
+// dragonfly crop geometry, WxH with optional +X+Y offsets, each in pixels or
+// a fraction with a decimal point
+var cropRegex = regexp.MustCompile(`^(\d+(?:\.\d+)?)x(\d+(?:\.\d+)?)(?:\+(\d+(?:\.\d+)?)\+(\d+(?:\.\d+)?))?$`)
+
+// imgproxy preset name
+var presetRegex = regexp.MustCompile(`^[a-zA-Z0-9]+$`)
+
+// imgproxy gravity types
+var gravities = map[string]bool{
+	"no":   true,
+	"so":   true,
+	"ea":   true,
+	"we":   true,
+	"noea": true,
+	"nowe": true,
+	"soea": true,
+	"sowe": true,
+	"ce":   true,
+	"sm":   true,
+}
+
+// query parameters read by the middleware, never passed through
+var reservedParams = map[string]bool{
+	"sha":      true,
+	"convert":  true,
+	"extend":   true,
+	"format":   true,
+	"exp":      true,
+	"maxbytes": true,
+	"tenant":   true,
+	"focus":    true,
+	"dpr":      true,
+	"filename": true,
+	"page":     true,
+}
+
+// imgproxy resizing algorithms
+var resizingAlgorithms = map[string]bool{
+	"nearest":  true,
+	"linear":   true,
+	"cubic":    true,
+	"lanczos2": true,
+	"lanczos3": true,
+}
+
+// source formats imgproxy can skip processing for
+var skipProcessingFormats = map[string]bool{
+	"jpg":  true,
+	"png":  true,
+	"webp": true,
+	"avif": true,
+	"gif":  true,
+	"svg":  true,
+	"ico":  true,
+	"heic": true,
+	"bmp":  true,
+	"tiff": true,
+}
+
+// fetch path extensions accepted with ImageOnly
+var imageExtensions = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+	".webp": true,
+	".avif": true,
+	".svg":  true,
+	".heic": true,
+	".heif": true,
+	".bmp":  true,
+	".tif":  true,
+	".tiff": true,
+	".ico":  true,
+	".jxl":  true,
+}
+
+// imgproxy adjustment option and accepted value range
+type adjustment struct {
+	option   string
+	min, max float64
+}
+
+// process jobs taking one argument that can follow the geometry of a thumb
+// job, the ones expandJobs splits out
+var packedOperations = map[string]bool{
+	"trim":       true,
+	"crop":       true,
+	"rotate":     true,
+	"zoom":       true,
+	"pixelate":   true,
+	"preset":     true,
+	"brightness": true,
+	"contrast":   true,
+	"saturation": true,
+}
+
+// imgproxy adjustments by process job name, brightness is added to the
+// channel values, contrast and saturation are factors where 1 leaves the
+// image unchanged
+var adjustments = map[string]adjustment{
+	"brightness": {"br", -255, 255},
+	"contrast":   {"co", 0, maxAdjustmentFactor},
+	"saturation": {"sa", 0, maxAdjustmentFactor},
+}
+
+// output formats which can be forced on imgproxy
+var outputFormats = map[string]bool{
+	"jpg":  true,
+	"png":  true,
+	"webp": true,
+	"avif": true,
+	"gif":  true,
 }
 
 // New returns a plugin instance.
-func New(_ context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
-	if len(config.DragonflySecret) == 0 {
-		return nil, errors.New("DragonflySecret required")
+func New(ctx context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
+	handler, err := NewHandler(ctx, next, config, name)
+	if err != nil {
+		return nil, err
+	}
+	return handler, nil
+}
+
+// NewHandler returns a plugin instance as its concrete type.
+func NewHandler(_ context.Context, next http.Handler, config *Config, name string) (*Dragonfly2imgproxy, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	config = config.normalize() // a copy, the caller's config is not changed
+	formatRoutes, err := compileFormatRoutes(config.FormatByPathRegex)
+	if err != nil {
+		return nil, err
+	}
+	urlRegex, err := mediaRegex(config.PathPrefix, config.ShaInPath, config.AllowedExtensions)
+	if err != nil {
+		return nil, err
+	}
+	var imgproxyBase *url.URL
+	if config.RedirectMode || config.AbsoluteRewrite {
+		imgproxyBase, _ = url.Parse(config.ImgproxyBaseURL) // checked in Validate
+	}
+	signer, err := newImgproxySigner(config)
+	if err != nil {
+		return nil, err
+	}
+	var processTimeout time.Duration
+	if len(config.ProcessTimeout) > 0 {
+		processTimeout, _ = time.ParseDuration(config.ProcessTimeout) // checked in Validate
+	}
+	// the secrets are fixed, their padded keys are hashed once here
+	hmacKeys := map[string]*hmacKey{}
+	secrets := append([]string{config.DragonflySecret}, config.AdditionalSecrets...)
+	for _, secret := range config.Secrets {
+		secrets = append(secrets, secret)
+	}
+	for _, secret := range secrets {
+		hmacKeys[secret], err = newHMACKey(secret, config.HashAlgorithm)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var collector *metrics
+	if config.EnableMetrics {
+		collector = newMetrics()
 	}
 
 	return &Dragonfly2imgproxy{
-		name:   name,
-		config: config,
-		next:   next,
+		name:           name,
+		config:         config,
+		next:           next,
+		formatRoutes:   formatRoutes,
+		metrics:        collector,
+		processTimeout: processTimeout,
+		urlRegex:       urlRegex,
+		hmacKeys:       hmacKeys,
+		imgproxyBase:   imgproxyBase,
+		signer:         signer,
 	}, nil
 
 }
 
+// Validate checks config the way New does, without building a handler. The
+// config is left unchanged, empty settings are checked with their defaults.
+func (config *Config) Validate() error {
+	if len(config.DragonflySecret) == 0 {
+		return errors.New("DragonflySecret required")
+	}
+	if config.ErrorFormat != "" && config.ErrorFormat != "text" && config.ErrorFormat != "json" {
+		return fmt.Errorf("Invalid ErrorFormat %q, must be text or json", config.ErrorFormat)
+	}
+	for _, secret := range config.AdditionalSecrets {
+		if len(secret) == 0 {
+			return errors.New("AdditionalSecrets must not contain empty secrets")
+		}
+	}
+	for _, tenant := range sortedKeys(config.Secrets) {
+		if secret := config.Secrets[tenant]; len(secret) == 0 {
+			return fmt.Errorf("Secrets[%q] must not be empty", tenant)
+		}
+	}
+	config = config.normalize() // checked with the defaults New fills in
+	if config.SourceURLMode != "" && config.SourceURLMode != "plain" && config.SourceURLMode != "base64" {
+		return fmt.Errorf("Invalid SourceURLMode %q, must be plain or base64", config.SourceURLMode)
+	}
+	if config.SourceType != "" && config.SourceType != "http" && config.SourceType != "local" {
+		return fmt.Errorf("Invalid SourceType %q, must be http or local", config.SourceType)
+	}
+	if err := validatePrefix("URLPrefix", config.URLPrefix, config.SourceType); err != nil {
+		return err
+	}
+	for _, key := range sortedKeys(config.Prefixes) {
+		if err := validatePrefix(fmt.Sprintf("Prefixes[%q]", key), config.Prefixes[key], config.SourceType); err != nil {
+			return err
+		}
+	}
+	newHash, ok := hashAlgorithms[config.HashAlgorithm]
+	if !ok {
+		return fmt.Errorf("Invalid HashAlgorithm %q, must be sha1, sha256 or sha512", config.HashAlgorithm)
+	}
+	if maxLength := newHash().Size() * 2; config.SignatureLength < 1 || config.SignatureLength > maxLength {
+		return fmt.Errorf("Invalid SignatureLength %d, must be between 1 and %d", config.SignatureLength, maxLength)
+	}
+	if config.ExpirySeconds < 0 {
+		return errors.New("ExpirySeconds must not be negative")
+	}
+	if len(config.DefaultPreset) > 0 && !presetRegex.MatchString(config.DefaultPreset) {
+		return fmt.Errorf("Invalid DefaultPreset %q, must be alphanumeric", config.DefaultPreset)
+	}
+	if _, err := compileFormatRoutes(config.FormatByPathRegex); err != nil {
+		return err
+	}
+	if config.JpegQuality < 0 || config.JpegQuality > 100 {
+		return fmt.Errorf("Invalid JpegQuality %d, must be between 0 and 100, 0 to disable", config.JpegQuality)
+	}
+	if config.WebpQuality < 0 || config.WebpQuality > 100 {
+		return fmt.Errorf("Invalid WebpQuality %d, must be between 0 and 100, 0 to disable", config.WebpQuality)
+	}
+	if !gravities[config.Gravity] {
+		return fmt.Errorf("Invalid Gravity %q", config.Gravity)
+	}
+	for _, format := range config.SkipProcessingFormats {
+		if !skipProcessingFormats[format] {
+			return fmt.Errorf("Invalid SkipProcessingFormats entry %q", format)
+		}
+	}
+	if len(config.ResizingAlgorithm) > 0 && !resizingAlgorithms[config.ResizingAlgorithm] {
+		return fmt.Errorf("Invalid ResizingAlgorithm %q", config.ResizingAlgorithm)
+	}
+	if len(config.DefaultResize) > 0 {
+		if _, _, _, err := parseThumbGeometry(config, config.DefaultResize, 0); err != nil {
+			return fmt.Errorf("Invalid DefaultResize %q: %w", config.DefaultResize, err)
+		}
+	}
+	if config.MissingShaStatus < 400 || config.MissingShaStatus > 599 {
+		return fmt.Errorf("Invalid MissingShaStatus %d, must be an error status", config.MissingShaStatus)
+	}
+	if config.MaxURLLength < 0 || config.MaxJobBytes < 0 {
+		return errors.New("MaxURLLength and MaxJobBytes must not be negative")
+	}
+	if config.MaxWidth < 0 || config.MaxHeight < 0 {
+		return errors.New("MaxWidth and MaxHeight must not be negative")
+	}
+	if _, err := mediaRegex(config.PathPrefix, config.ShaInPath, config.AllowedExtensions); err != nil {
+		return err
+	}
+	if config.RedirectMode || config.AbsoluteRewrite {
+		if base, err := url.Parse(config.ImgproxyBaseURL); err != nil || len(base.Scheme) == 0 || len(base.Host) == 0 {
+			return fmt.Errorf("ImgproxyBaseURL %q must have a scheme and host when RedirectMode or AbsoluteRewrite is on", config.ImgproxyBaseURL)
+		}
+	}
+	if _, err := newImgproxySigner(config); err != nil {
+		return err
+	}
+	if len(config.ProcessTimeout) > 0 {
+		if timeout, err := time.ParseDuration(config.ProcessTimeout); err != nil || timeout < 0 {
+			return fmt.Errorf("Invalid ProcessTimeout %q", config.ProcessTimeout)
+		}
+	}
+	return nil
+}
+
 // ServeHTTP serves an HTTP request.
 func (d *Dragonfly2imgproxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-
-	regex := regexp.MustCompile(`\/media\/(.+?)(\.gif|.png|.jpeg|.jpg|.webp|.avif)*$`)
-
-	// Get base64 from url path
-	match := regex.FindStringSubmatch(req.URL.Path)
+	if d.skipPath(req.URL.Path) { // not an image request, e.g. health checks
+		d.next.ServeHTTP(rw, req)
+		return
+	}
+	// Get base64 from the decoded url path, so %3D padding or %2B from
+	// standard base64 arrive decoded whichever form the client sent
+	match := d.urlRegex.FindStringSubmatch(req.URL.Path)
+	if len(match) < 3 && d.config.PassthroughUnmatched { // not counted in metrics
+		d.next.ServeHTTP(rw, req)
+		return
+	}
+	logger := d.requestLogger(req)
+	failure := "" // set by rejections counted apart from their status
+	if d.metrics != nil {
+		recorder := &statusRecorder{ResponseWriter: rw, status: http.StatusOK}
+		rw = recorder
+		defer func() { d.metrics.record(recorder.status, failure) }()
+	}
 	if len(match) < 3 {
-		log.Println("Failed to extract base64 string from URL. match=" + strconv.Itoa((len(match))))
-		http.Error(rw, "Failed to extract base64 string from URL.", http.StatusInternalServerError)
+		logger.Println("Failed to extract base64 string from URL. match=" + strconv.Itoa((len(match))))
+		d.error(rw, "Failed to extract base64 string from URL.", "URL_MISMATCH", http.StatusBadRequest)
 		return
 	}
 	base64String := match[1]
+	// a proxy encoding the path again leaves escapes after one decoding,
+	// base64 never contains % so unescape once more
+	if strings.Contains(base64String, "%") {
+		if unescaped, err := url.PathUnescape(base64String); err == nil {
+			base64String = unescaped
+		}
+	}
 
-	// Get sha from query string
+	// Get sha from query string or url path
 	sha := req.URL.Query().Get("sha")
+	if d.config.ShaInPath {
+		sha = match[2]
+	}
+	if trimmed := strings.TrimSpace(sha); trimmed != sha {
+		logger.Println("Trimmed surrounding whitespace from sha.")
+		sha = trimmed
+	}
 	if len(sha) == 0 {
-		log.Println("Failed to get sha from query string.")
-		http.Error(rw, "Failed to get sha from query string.", http.StatusInternalServerError)
+		logger.Println("Failed to get sha from query string.")
+		d.error(rw, "Failed to get sha from query string.", "MISSING_SHA", d.config.MissingShaStatus)
 		return
 	}
 
+	// padded standard base64 is the longest encoding of MaxJobBytes, longer
+	// payloads are rejected before allocating for them
+	if d.config.MaxJobBytes > 0 && len(base64String) > base64.StdEncoding.EncodedLen(d.config.MaxJobBytes) {
+		logger.Println("Jobs too large:", len(base64String))
+		d.error(rw, "Jobs too large.", "JOBS_TOO_LARGE", http.StatusBadRequest)
+		return
+	}
 	// Base64 decode jobs
-	jobBytes, err := base64.RawURLEncoding.DecodeString(base64String)
+	jobBytes, err := decodeBase64(base64String)
 	if err != nil {
-		log.Println("Base64 decode error:", err)
-		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		logger.Println("Base64 decode error:", err)
+		failure = failureBase64
+		d.error(rw, err.Error(), "INVALID_BASE64", http.StatusBadRequest)
+		return
+	}
+	if d.config.MaxJobBytes > 0 && len(jobBytes) > d.config.MaxJobBytes {
+		logger.Println("Jobs too large:", len(jobBytes))
+		d.error(rw, "Jobs too large.", "JOBS_TOO_LARGE", http.StatusBadRequest)
 		return
 	}
 	// to job string
@@ -87,96 +684,1321 @@ func (d *Dragonfly2imgproxy) ServeHTTP(rw http.ResponseWriter, req *http.Request
 	var jobs [][]string
 	err = json.Unmarshal([]byte(job_string), &jobs)
 	if err != nil {
-		log.Println("Parse JSON failed:", err)
-		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		// older signers may emit a single job without the outer array
+		var job []string
+		singleErr := json.Unmarshal([]byte(job_string), &job)
+		if singleErr != nil && json.Valid(jobBytes) {
+			// valid JSON of the wrong shape, e.g. an object
+			logger.Println("Invalid jobs shape:", err)
+			failure = failureJSON
+			d.error(rw, "Jobs must be an array of arrays of strings.", "INVALID_JOBS_SHAPE", http.StatusBadRequest)
+			return
+		} else if singleErr != nil {
+			logger.Println("Parse JSON failed:", err)
+			failure = failureJSON
+			d.error(rw, err.Error(), "INVALID_JSON", http.StatusBadRequest)
+			return
+		}
+		if !d.config.AllowSingleJobShape {
+			logger.Println("Single job shape is not allowed")
+			d.error(rw, "Jobs must be an array of jobs, got a single job.", "SINGLE_JOB_SHAPE", http.StatusBadRequest)
+			return
+		}
+		jobs = [][]string{job}
+	}
+	if len(jobs) == 0 {
+		logger.Println("Empty jobs.")
+		d.error(rw, "Jobs must not be empty.", "EMPTY_JOBS", http.StatusBadRequest)
 		return
 	}
+	for _, job := range jobs {
+		if len(job) < 2 { // every job has a type and an argument
+			logger.Println("Invalid job:", job)
+			d.error(rw, "Jobs must have a type and an argument.", "INVALID_JOBS", http.StatusBadRequest)
+			return
+		}
+	}
 
-	if calculateSHA(d.config.DragonflySecret, jobs) != sha {
-		log.Println("SHA validate failed")
-		http.Error(rw, "SHA validate failed", http.StatusInternalServerError)
+	// expiry is signed along with the jobs so it can't be tampered with
+	signed_jobs := jobs
+	var expires int64
+	if d.config.ExpirySeconds > 0 {
+		exp := req.URL.Query().Get("exp")
+		expires, err = strconv.ParseInt(exp, 10, 64)
+		if err != nil {
+			logger.Println("Failed to get exp from query string.")
+			d.error(rw, "Failed to get exp from query string.", "INVALID_EXP", http.StatusBadRequest)
+			return
+		}
+		signed_jobs = append(append([][]string{}, jobs...), []string{"e", exp})
+	}
+
+	signatures, err := d.signatures(req, signed_jobs)
+	if err != nil {
+		logger.Println("SHA validate failed:", err)
+		failure = failureSha
+		d.error(rw, err.Error(), "UNKNOWN_TENANT", http.StatusBadRequest)
+		return
+	}
+	// every signature is checked so timing doesn't tell which one matched
+	valid := false
+	for _, signature := range signatures {
+		if hmac.Equal([]byte(signature), []byte(sha)) {
+			valid = true
+		}
+	}
+	if !valid {
+		logger.Println("SHA validate failed")
+		failure = failureSha
+		d.error(rw, "SHA validate failed", "SHA_MISMATCH", http.StatusForbidden)
+		return
+	}
+	if filePath, ok := d.allowedSource(jobs); !ok {
+		logger.Println("Fetch path not allowed:", filePath)
+		d.error(rw, "Fetch path not allowed.", "PATH_NOT_ALLOWED", http.StatusForbidden)
+		return
+	}
+	if filePath, ok := d.imageSource(jobs); !ok {
+		logger.Println("Fetch path is not an image:", filePath)
+		d.error(rw, "Fetch path is not an image.", "NOT_AN_IMAGE", http.StatusBadRequest)
+		return
+	}
+	if d.config.ExpirySeconds > 0 {
+		now := time.Now().Unix()
+		if now > expires {
+			logger.Println("URL expired")
+			d.error(rw, "URL expired", "URL_EXPIRED", http.StatusForbidden)
+			return
+		}
+		if expires-now > int64(d.config.ExpirySeconds) {
+			logger.Println("URL expiry exceeds ExpirySeconds")
+			d.error(rw, "URL expiry too far in the future", "EXPIRY_TOO_FAR", http.StatusForbidden)
+			return
+		}
+	}
+	options, err := d.parseRequestOptions(req)
+	if err != nil {
+		logger.Println("Invalid request options:", err)
+		d.error(rw, err.Error(), "INVALID_OPTIONS", http.StatusBadRequest)
+		return
+	}
+	generateStart := time.Now()
+	imgproxy_url, err := writeImgproxyURL(&bytes.Buffer{}, d.config, d.signer, jobs, options)
+	d.metrics.observeGenerate(generateStart)
+	if err != nil {
+		logger.Println("Generate imgproxy url failed:", err)
+		d.error(rw, err.Error(), "INVALID_JOBS", http.StatusBadRequest)
+		return
+	}
+	logger.Println("generate imgproxy url=" + imgproxy_url)
+	if d.config.MaxURLLength > 0 && len(imgproxy_url) > d.config.MaxURLLength {
+		logger.Println("Generated imgproxy url too long:", len(imgproxy_url))
+		d.error(rw, "Generated imgproxy url too long.", "URL_TOO_LONG", http.StatusRequestURITooLong)
+		return
+	}
+	if len(d.config.DebugEndpoint) > 0 && strings.HasPrefix(req.URL.Path, d.config.DebugEndpoint) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(rw).Encode(debugResponse{Jobs: jobs, URL: imgproxy_url}); err != nil {
+			logger.Println("Write debug response failed:", err)
+		}
+		return
+	}
+	headers := http.Header{}
+	if len(d.config.TimingAllowOrigin) > 0 {
+		headers.Set("Timing-Allow-Origin", d.config.TimingAllowOrigin)
+	}
+	if d.config.DebugHeaders {
+		if jobsJSON, err := json.Marshal(jobs); err == nil {
+			headers.Set("X-Dragonfly-Jobs", string(jobsJSON))
+		}
+	}
+	if len(headers) > 0 || len(d.config.CacheControl) > 0 {
+		wrapped := newResponseWriter(rw, headers)
+		wrapped.cacheControl = d.config.CacheControl
+		wrapped.cacheControlOverride = d.config.CacheControlOverride
+		rw = wrapped
+	}
+	if d.config.RedirectMode { // imgproxy is not behind this router
+		location := d.config.ImgproxyBaseURL + imgproxy_url
+		if query := d.passthroughQuery(req.URL.Query()); len(query) > 0 {
+			location += "?" + query
+		}
+		http.Redirect(rw, req, location, http.StatusFound)
 		return
 	}
-	var imgproxy_url = generate_imgproxy_url(d.config.URLPrefix, jobs)
-	log.Println("generate imgproxy url=" + imgproxy_url)
-	// auto_convert=false replace Accept header with only traditional image format
-	if req.URL.Query().Get("convert") == "false" {
-		log.Println("convert=false turn off Accept Header")
+	// convert=false replace Accept header with only traditional image format,
+	// convert=true forces ForceAccept or webp, convert=auto keeps the client
+	// Accept, without convert ForceAccept applies when set
+	switch convertMode(req.URL.Query()) {
+	case "false":
+		logger.Println("convert=false turn off Accept Header")
 		req.Header.Del("Accept")
+		if d.config.StripAcceptEncoding {
+			req.Header.Del("Accept-Encoding")
+		}
+	case "true":
+		accept := d.config.ForceAccept
+		if len(accept) == 0 {
+			accept = "image/webp"
+		}
+		logger.Println("convert=true force Accept Header:", accept)
+		req.Header.Set("Accept", accept)
+	case "auto": // keep the client Accept
+	default:
+		if len(d.config.ForceAccept) > 0 {
+			req.Header.Set("Accept", d.config.ForceAccept)
+		}
 	}
-	req.URL.Path = imgproxy_url
-	req.URL.RawQuery = "" // clean query string
+	// imgproxy_url is already escaped, keep it as RawPath so % is not escaped twice
+	req.URL.Path, err = url.PathUnescape(imgproxy_url)
+	if err != nil {
+		logger.Println("Unescape imgproxy url failed:", err)
+		d.error(rw, err.Error(), "INTERNAL_ERROR", http.StatusInternalServerError)
+		return
+	}
+	req.URL.RawPath = imgproxy_url
+	req.URL.RawQuery = d.passthroughQuery(req.URL.Query()) // clean query string
 	req.RequestURI = imgproxy_url
-
+	if d.config.AbsoluteRewrite { // next needs the full imgproxy url
+		req.URL.Scheme = d.imgproxyBase.Scheme
+		req.URL.Host = d.imgproxyBase.Host
+		req.URL.Path = d.imgproxyBase.Path + req.URL.Path
+		req.URL.RawPath = d.imgproxyBase.EscapedPath() + imgproxy_url
+		req.Host = d.imgproxyBase.Host
+		req.RequestURI = d.config.ImgproxyBaseURL + imgproxy_url
+	}
+	if len(req.URL.RawQuery) > 0 {
+		req.RequestURI += "?" + req.URL.RawQuery
+	}
+	if d.processTimeout > 0 { // don't wait forever on a hung imgproxy
+		ctx, cancel := context.WithTimeout(req.Context(), d.processTimeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
 	d.next.ServeHTTP(rw, req)
 }
 
+// Copy of config in the form the handler uses, the caller's config is left untouched
+func (config *Config) normalize() *Config {
+	normalized := *config
+	normalized.URLPrefix = normalizePrefix(config.URLPrefix)
+	normalized.ImgproxyBaseURL = strings.TrimSuffix(config.ImgproxyBaseURL, "/")
+	if normalized.SignatureLength == 0 {
+		normalized.SignatureLength = defaultSignatureLength
+	}
+	if len(normalized.HashAlgorithm) == 0 {
+		normalized.HashAlgorithm = defaultHashAlgorithm
+	}
+	if len(normalized.Gravity) == 0 {
+		normalized.Gravity = "ce"
+	}
+	if normalized.MissingShaStatus == 0 {
+		normalized.MissingShaStatus = http.StatusBadRequest
+	}
+	// one leading and one trailing slash, /assets/ for assets
+	if len(normalized.PathPrefix) == 0 {
+		normalized.PathPrefix = defaultPathPrefix
+	} else if trimmed := strings.Trim(normalized.PathPrefix, "/"); len(trimmed) > 0 {
+		normalized.PathPrefix = "/" + trimmed + "/"
+	} else {
+		normalized.PathPrefix = "/"
+	}
+	normalized.SkipProcessingFormats = make([]string, 0, len(config.SkipProcessingFormats))
+	for _, format := range config.SkipProcessingFormats {
+		normalized.SkipProcessingFormats = append(normalized.SkipProcessingFormats, strings.ToLower(strings.TrimPrefix(format, ".")))
+	}
+	normalized.Prefixes = make(map[string]string, len(config.Prefixes))
+	for key, prefix := range config.Prefixes {
+		normalized.Prefixes[key] = normalizePrefix(prefix)
+	}
+	return &normalized
+}
+
+// Dragonfly media url regex, /media/<b64>.jpg?sha=<sha> or with the sha in the
+// path, /media/<b64>/<sha>.jpg, for the pathPrefix /media/, the optional
+// extension is matched case-insensitively
+func mediaRegex(pathPrefix string, shaInPath bool, extensions []string) (*regexp.Regexp, error) {
+	if len(extensions) == 0 {
+		extensions = defaultExtensions
+	}
+	patterns := make([]string, 0, len(extensions))
+	for _, ext := range extensions {
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		if !extensionRegex.MatchString(ext) {
+			return nil, fmt.Errorf("Invalid AllowedExtensions entry %q", ext)
+		}
+		patterns = append(patterns, regexp.QuoteMeta(ext))
+	}
+	extensionPattern := `((?i)` + strings.Join(patterns, "|") + `)*$`
+	if shaInPath {
+		return regexp.Compile(regexp.QuoteMeta(pathPrefix) + `(.+?)\/([0-9a-fA-F]+)` + extensionPattern)
+	}
+	return regexp.Compile(regexp.QuoteMeta(pathPrefix) + `(.+?)` + extensionPattern)
+}
+
+// Logger prefixing lines with the RequestIDHeader value, which is generated
+// and set on the request when missing so imgproxy logs the same id
+func (d *Dragonfly2imgproxy) requestLogger(req *http.Request) *log.Logger {
+	if len(d.config.RequestIDHeader) == 0 {
+		return log.Default()
+	}
+	id := req.Header.Get(d.config.RequestIDHeader)
+	if len(id) == 0 {
+		random := make([]byte, 8)
+		if _, err := rand.Read(random); err == nil {
+			id = hex.EncodeToString(random)
+			req.Header.Set(d.config.RequestIDHeader, id)
+		}
+	}
+	return log.New(log.Writer(), "request_id="+id+" ", log.Flags()|log.Lmsgprefix)
+}
+
+// Write an error response as plain text, or as {"error": ..., "code": ...}
+// when ErrorFormat is json
+func (d *Dragonfly2imgproxy) error(rw http.ResponseWriter, message string, code string, status int) {
+	if d.config.ErrorFormat != "json" {
+		http.Error(rw, message, status)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.WriteHeader(status)
+	if err := json.NewEncoder(rw).Encode(errorResponse{Error: message, Code: code}); err != nil {
+		log.Println("Write error response failed:", err)
+	}
+}
+
+// Append the trailing slash, a prefix is joined directly with the file path
+func normalizePrefix(prefix string) string {
+	if len(prefix) > 0 && !strings.HasSuffix(prefix, "/") {
+		return prefix + "/"
+	}
+	return prefix
+}
+
+// Validate a source prefix against SourceType, name is used in errors
+func validatePrefix(name string, prefix string, sourceType string) error {
+	if len(prefix) == 0 {
+		return errors.New(name + " required")
+	}
+	prefixURL, err := url.Parse(prefix)
+	if err != nil {
+		return fmt.Errorf("Invalid %s %q: %w", name, prefix, err)
+	}
+	if sourceType == "local" {
+		if len(prefixURL.Scheme) > 0 || len(prefixURL.Host) > 0 || !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("%s %q must be an absolute path when SourceType is local", name, prefix)
+		}
+	} else if len(prefixURL.Scheme) == 0 || len(prefixURL.Host) == 0 {
+		return fmt.Errorf("%s %q must have a scheme and host when SourceType is http", name, prefix)
+	}
+	return nil
+}
+
+// Compile FormatByPathRegex, sorted by pattern so the first match is stable
+func compileFormatRoutes(routes map[string]string) ([]formatRoute, error) {
+	patterns := sortedKeys(routes)
+	formatRoutes := make([]formatRoute, 0, len(patterns))
+	for _, pattern := range patterns {
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid FormatByPathRegex pattern %q: %w", pattern, err)
+		}
+		format := strings.ToLower(routes[pattern])
+		if !outputFormats[format] {
+			return nil, fmt.Errorf("Invalid FormatByPathRegex format %q for pattern %q", routes[pattern], pattern)
+		}
+		formatRoutes = append(formatRoutes, formatRoute{regex: regex, format: format})
+	}
+	return formatRoutes, nil
+}
+
+// Forced output format for the request path, empty when no route matches
+func (d *Dragonfly2imgproxy) formatForPath(path string) string {
+	for _, route := range d.formatRoutes {
+		if route.regex.MatchString(path) {
+			return route.format
+		}
+	}
+	return ""
+}
+
+// Read the per-request imgproxy options from the query string
+func (d *Dragonfly2imgproxy) parseRequestOptions(req *http.Request) (requestOptions, error) {
+	query := req.URL.Query()
+	options := requestOptions{
+		format: d.formatForPath(req.URL.Path),
+		extend: query.Get("extend") == "true",
+	}
+	// explicit format overrides route format and Accept negotiation
+	if format := strings.ToLower(query.Get("format")); len(format) > 0 {
+		if !outputFormats[format] {
+			return options, errors.New("Unsupported format: " + format)
+		}
+		options.format = format
+	}
+	// an explicit f:avif keeps cached urls independent of imgproxy negotiation
+	if convert := convertMode(query); d.config.PreferAvif && convert != "false" && convert != "true" {
+		options.avif = strings.Contains(req.Header.Get("Accept"), "image/avif")
+	}
+	if maxBytes := query.Get("maxbytes"); len(maxBytes) > 0 {
+		value, err := strconv.Atoi(maxBytes)
+		if err != nil || value <= 0 {
+			return options, errors.New("Invalid maxbytes: " + maxBytes)
+		}
+		options.maxBytes = value
+	}
+	// the Sec-CH-DPR client hint wins over the dpr query parameter
+	dpr := query.Get("dpr")
+	if hint := req.Header.Get("Sec-CH-DPR"); d.config.UseClientHints && len(hint) > 0 {
+		dpr = hint
+	}
+	if len(dpr) > 0 {
+		value, err := strconv.ParseFloat(dpr, 64)
+		if err != nil || !(value > 0 && value <= maxDPR) {
+			return options, errors.New("Invalid dpr: " + dpr)
+		}
+		options.dpr = value
+	}
+	if page := query.Get("page"); len(page) > 0 {
+		value, err := strconv.Atoi(page)
+		if err != nil || value < 0 {
+			return options, errors.New("Invalid page: " + page)
+		}
+		options.page = strconv.Itoa(value)
+	}
+	// download filename without directories or control characters
+	if filename := query.Get("filename"); len(filename) > 0 {
+		filename = strings.Map(func(r rune) rune {
+			if r < 0x20 || r == 0x7f || r == '/' || r == '\\' {
+				return -1
+			}
+			return r
+		}, filename)
+		if len(strings.Trim(filename, ". ")) == 0 {
+			return options, errors.New("Invalid filename: " + query.Get("filename"))
+		}
+		options.filename = filename
+	}
+	// focus=0.5,0.5 fills around a focal point, 0 to 1 from the top left
+	if focus := query.Get("focus"); len(focus) > 0 {
+		coordinates := strings.Split(focus, ",")
+		if len(coordinates) != 2 {
+			return options, errors.New("Invalid focus: " + focus)
+		}
+		for i, coordinate := range coordinates {
+			value, err := strconv.ParseFloat(coordinate, 64)
+			if err != nil || !(value >= 0 && value <= 1) {
+				return options, errors.New("Invalid focus: " + focus)
+			}
+			coordinates[i] = strconv.FormatFloat(value, 'f', -1, 64)
+		}
+		options.focus = strings.Join(coordinates, ":")
+	}
+	return options, nil
+}
+
+// convert query parameter as "false", "true", "auto" or as sent, ignoring
+// case and taking 0/no and 1/yes for false and true
+func convertMode(query url.Values) string {
+	convert := strings.ToLower(query.Get("convert"))
+	switch convert {
+	case "0", "no":
+		return "false"
+	case "1", "yes":
+		return "true"
+	}
+	return convert
+}
+
+// Path is one of SkipPaths or below one of them
+func (d *Dragonfly2imgproxy) skipPath(requestPath string) bool {
+	for _, skip := range d.config.SkipPaths {
+		skip = strings.TrimSuffix(skip, "/")
+		if requestPath == skip || strings.HasPrefix(requestPath, skip+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Signatures of jobs accepted for the request, with the tenant secret or
+// DragonflySecret followed by AdditionalSecrets without a tenant
+func (d *Dragonfly2imgproxy) signatures(req *http.Request, jobs [][]string) ([]string, error) {
+	tenant := req.URL.Query().Get("tenant")
+	if len(tenant) == 0 {
+		signatures := []string{d.sha(jobs)}
+		for _, secret := range d.config.AdditionalSecrets {
+			signatures = append(signatures, d.signature(secret, jobs))
+		}
+		return signatures, nil
+	}
+	secret, ok := d.config.Secrets[tenant]
+	if !ok {
+		return nil, fmt.Errorf("Unknown tenant %q", tenant)
+	}
+	return []string{d.signature(secret, jobs)}, nil
+}
+
+// calculateSHA of jobs with DragonflySecret and the configured HashAlgorithm
+// and SignatureLength
+func (d *Dragonfly2imgproxy) sha(jobs [][]string) string {
+	return d.signature(d.config.DragonflySecret, jobs)
+}
+
+// calculateSHA with the key states of secret computed in NewHandler
+func (d *Dragonfly2imgproxy) signature(secret string, jobs [][]string) string {
+	return hexSignature(d.hmacKeys[secret].sum(jobsMessage(jobs)), d.config.SignatureLength)
+}
+
+// Check fetch paths against AllowedPathPrefixes, returns the first rejected path
+func (d *Dragonfly2imgproxy) allowedSource(jobs [][]string) (string, bool) {
+	if len(d.config.AllowedPathPrefixes) == 0 {
+		return "", true
+	}
+	for _, job := range jobs {
+		if len(job) < 2 || job[0] != "f" {
+			continue
+		}
+		filePath := job[len(job)-1]
+		if !isAbsoluteSource(filePath) {
+			filePath = path.Clean(filePath) // no escaping the prefix with ../
+		}
+		allowed := false
+		for _, prefix := range d.config.AllowedPathPrefixes {
+			if strings.HasPrefix(filePath, prefix) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return job[len(job)-1], false
+		}
+	}
+	return "", true
+}
+
+// Check fetch path extensions when ImageOnly, returns the first rejected path
+func (d *Dragonfly2imgproxy) imageSource(jobs [][]string) (string, bool) {
+	if !d.config.ImageOnly {
+		return "", true
+	}
+	for _, job := range jobs {
+		if len(job) < 2 || job[0] != "f" {
+			continue
+		}
+		filePath := job[len(job)-1]
+		if lower := strings.ToLower(filePath); strings.HasPrefix(lower, "data:") {
+			if !strings.HasPrefix(lower, "data:image/") {
+				return filePath, false
+			}
+			continue
+		}
+		if isAbsoluteSource(filePath) { // ignore the query string
+			if sourceURL, err := url.Parse(filePath); err == nil {
+				filePath = sourceURL.Path
+			}
+		}
+		if !imageExtensions[strings.ToLower(path.Ext(filePath))] {
+			return job[len(job)-1], false
+		}
+	}
+	return "", true
+}
+
+// Map keys in sorted order, config maps are never iterated in map order so
+// errors and generated urls are the same on every run
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Query string with only the PassthroughParams keys, sorted by key
+func (d *Dragonfly2imgproxy) passthroughQuery(query url.Values) string {
+	passthrough := url.Values{}
+	for _, key := range d.config.PassthroughParams {
+		if values, ok := query[key]; ok && !reservedParams[key] {
+			passthrough[key] = values
+		}
+	}
+	return passthrough.Encode()
+}
+
+// Decode url-safe base64, falling back to standard base64 with or without padding
+func decodeBase64(s string) ([]byte, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		return decoded, nil
+	}
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding} {
+		if decoded, stdErr := encoding.DecodeString(s); stdErr == nil {
+			return decoded, nil
+		}
+	}
+	return nil, err
+}
+
+// Escape one path segment, spaces as %20 and "/" as %2F, unlike QueryEscape
+// "&", "=" and "+" are valid in a path and left as is
 func customEscape(s string) string {
-	encoded := url.QueryEscape(s)
-	// space -> %20
-	encoded = strings.ReplaceAll(encoded, "+", "%20")
+	encoded := url.PathEscape(s)
+	// imgproxy reads @ in a plain source url as the output extension
+	encoded = strings.ReplaceAll(encoded, "@", "%40")
 	return encoded
 }
 
-// Generate imgproxy url
-func generate_imgproxy_url(url_prefix string, jobs [][]string) string {
-	imgproxy_url := url_prefix
-	thumb_operation := ""
+// Generate imgproxy url, job options are emitted in job order so crop then
+// thumb and thumb then crop give different urls, only trim always comes
+// first. imgproxy itself still runs its fixed pipeline whatever the order.
+func generate_imgproxy_url(config *Config, jobs [][]string, options requestOptions) (string, error) {
+	signer, err := newImgproxySigner(config)
+	if err != nil {
+		return "", err
+	}
+	return writeImgproxyURL(&bytes.Buffer{}, config, signer, jobs, options)
+}
+
+// generate_imgproxy_url building the url in buffer, so batches can reuse one,
+// signed by signer or /insecure when it is nil
+func writeImgproxyURL(buffer *bytes.Buffer, config *Config, signer *imgproxySigner, jobs [][]string, options requestOptions) (string, error) {
+	source_url := ""
+	source_format := ""     // format of the fetched file, from its extension
+	var operations []string // one imgproxy option per job, in job order
+	// trim goes ahead of every other option, whatever its job position, since
+	// imgproxy's pipeline always trims before resizing; the url reads in the
+	// order the image is processed, and a later trim job replaces an earlier one
+	trim_operation := ""
 	var is_gif = false
+	var is_svg = false
+	var is_avif = false
+	var is_resized = false
+	resize_width, resize_height := 0, 0 // from the last thumb, 0 when not given
+	zoom_x, zoom_y := 1.0, 1.0
+	gravity := config.Gravity
+	if len(gravity) == 0 {
+		gravity = "ce"
+	}
+	if len(options.focus) > 0 { // unsigned focus point from the query
+		gravity = "fp:" + options.focus
+	}
+	jobs, err := expandJobs(jobs)
+	if err != nil {
+		return "", err
+	}
+	if len(config.DefaultResize) > 0 && !hasProcessJob(jobs) { // cap unprocessed images
+		jobs = append(jobs, []string{"p", "thumb", config.DefaultResize})
+	}
 	for _, job := range jobs {
+		if len(job) < 2 {
+			return "", fmt.Errorf("Invalid job: %q", job)
+		}
 		if job[0] == "f" { //fetch image
+			url_prefix := config.URLPrefix
 			filePath := job[1]
-			dir, fileName := filepath.Split(filePath)
-			encodedFileName := customEscape(fileName)
-			encodedFilePath := filepath.Join(dir, encodedFileName)
-			imgproxy_url += encodedFilePath
-			imgproxy_url = "/plain/" + imgproxy_url
-			if strings.HasSuffix(imgproxy_url, ".gif") {
-				is_gif = true
+			if len(job) > 2 { // ["f", prefix key, path]
+				prefix, ok := config.Prefixes[job[1]]
+				if !ok {
+					return "", fmt.Errorf("Unknown source prefix: %q", job[1])
+				}
+				url_prefix = prefix
+				filePath = job[2]
 			}
+			if isAbsoluteSource(filePath) { // full url, URLPrefix not prepended
+				source_url = filePath
+				if config.SourceURLMode != "base64" {
+					// escaped as a whole so its ? and @ stay inside the plain source
+					source_url = customEscape(filePath)
+				}
+			} else {
+				// escape every path segment, directories may have spaces too
+				segments := strings.Split(path.Clean(filePath), "/")
+				for i, segment := range segments {
+					segments[i] = customEscape(segment)
+				}
+				source_url = url_prefix + strings.Join(segments, "/")
+				if config.SourceType == "local" { // imgproxy local filesystem
+					source_url = "local://" + source_url
+				}
+			}
+			// detect the format from the fetched file itself, not the prefix
+			ext := strings.ToLower(strings.TrimPrefix(path.Ext(filePath), "."))
+			if ext == "jpeg" {
+				ext = "jpg"
+			}
+			source_format = ""
+			if outputFormats[ext] {
+				source_format = ext
+			}
+			is_gif = ext == "gif"
+			is_svg = ext == "svg"
+			is_avif = ext == "avif"
 		} else if job[0] == "p" { // process image
 			if job[1] == "thumb" { // thumb only
-				regex := regexp.MustCompile(`^(\d+)x(|\d+)(|>|#)$`)
-				match := regex.FindStringSubmatch(job[2])
-				if len(match) < 1 {
-					fmt.Println("Failed to extract job")
-					return "Failed to extract job"
-				}
-				width := match[1]
-				height := match[2]
-				operation := match[3] // only support > #
+				if len(job) < 3 {
+					return "", errors.New("Failed to extract job")
+				}
+				match, width, height, err := parseThumbGeometry(config, job[2], options.dpr)
+				if err != nil {
+					return "", err
+				}
+				resize_width, _ = strconv.Atoi(width)
+				resize_height, _ = strconv.Atoi(height)
+				operation := match[3] // only support > < # ! ^
+				// rs:%type:%width:%height:%enlarge:%extend, so a trailing :0
+				// disables enlarging (shrink only) and :1 enables it
 				if operation == ">" {
-					thumb_operation += "/rs:fit:" + width + ":" + height + ":0"
+					operations = append(operations, "rs:fit:"+width+":"+height+":0")
+				} else if operation == "<" {
+					operations = append(operations, "rs:fit:"+width+":"+height+":1")
+				} else if operation == "#" && len(match[4]) > 0 && len(options.focus) == 0 {
+					operations = append(operations, "rs:fill:"+width+":"+height, "g:"+gravity+":"+strings.TrimPrefix(match[4], "+")+":"+strings.TrimPrefix(match[5], "+"))
 				} else if operation == "#" {
-					thumb_operation += "/rs:fill:" + width + ":" + height + ":g:ce"
+					operations = append(operations, "rs:fill:"+width+":"+height+":g:"+gravity)
+				} else if operation == "!" && config.ForceGeometryAsFill {
+					operations = append(operations, "rs:fill:"+width+":"+height, "g:"+gravity)
+				} else if operation == "!" {
+					operations = append(operations, "rs:force:"+width+":"+height)
+				} else if operation == "^" && config.CaretAsMinDimensions {
+					if width != "0" {
+						operations = append(operations, "mw:"+width)
+					}
+					if height != "0" {
+						operations = append(operations, "mh:"+height)
+					}
+				} else if operation == "^" {
+					operations = append(operations, "rs:fill:"+width+":"+height)
+				} else if !config.AllowEnlarge {
+					operations = append(operations, "rs:fit:"+width+":"+height+":0")
 				} else {
-					thumb_operation += "/rs:fit:" + width + ":" + height
+					operations = append(operations, "rs:fit:"+width+":"+height)
+				}
+				is_resized = true
+			} else if job[1] == "trim" { // trim borders
+				operation, err := trimOperation(job[2:])
+				if err != nil {
+					return "", err
+				}
+				trim_operation = operation
+			} else if job[1] == "crop" { // crop WxH+X+Y
+				if len(job) < 3 {
+					return "", errors.New("Crop requires a geometry")
+				}
+				operation, err := cropOperation(job[2])
+				if err != nil {
+					return "", err
+				}
+				operations = append(operations, operation)
+			} else if job[1] == "rotate" { // rotate by multiples of 90 degrees
+				if len(job) < 3 {
+					return "", errors.New("Rotate requires an angle")
+				}
+				angle, err := strconv.Atoi(job[2])
+				if err != nil || angle%90 != 0 {
+					return "", fmt.Errorf("Invalid rotate angle: %q, must be a multiple of 90", job[2])
+				}
+				operations = append(operations, "rot:"+strconv.Itoa((angle%360+360)%360))
+			} else if job[1] == "zoom" { // zoom by one factor or x and y factors
+				operation, x, y, err := zoomOperation(job[2:])
+				if err != nil {
+					return "", err
+				}
+				zoom_x, zoom_y = x, y
+				operations = append(operations, operation)
+			} else if job[1] == "watermark" { // watermark configured in imgproxy
+				operation, err := watermarkOperation(job[2:])
+				if err != nil {
+					return "", err
+				}
+				operations = append(operations, operation)
+			} else if job[1] == "watermark_url" { // watermark fetched from a signed url
+				if len(job) < 4 {
+					return "", errors.New("Watermark url requires a url and an opacity")
+				}
+				if lower := strings.ToLower(job[2]); !strings.HasPrefix(lower, "http://") && !strings.HasPrefix(lower, "https://") {
+					return "", fmt.Errorf("Invalid watermark url: %q", job[2])
+				}
+				operation, err := watermarkOperation(job[3:])
+				if err != nil {
+					return "", err
+				}
+				operations = append(operations, "wmu:"+base64.RawURLEncoding.EncodeToString([]byte(job[2])), operation)
+			} else if job[1] == "pad" { // padding, filled with the imgproxy background
+				operation, err := padOperation(job[2:])
+				if err != nil {
+					return "", err
+				}
+				operations = append(operations, operation)
+			} else if job[1] == "pixelate" { // pixelate by block size
+				operation, err := pixelateOperation(job[2:])
+				if err != nil {
+					return "", err
+				}
+				operations = append(operations, operation)
+			} else if _, ok := adjustments[job[1]]; ok { // brightness, contrast, saturation
+				operation, err := adjustmentOperation(job[1], job[2:])
+				if err != nil {
+					return "", err
+				}
+				operations = append(operations, operation)
+			} else if job[1] == "preset" { // imgproxy named presets
+				if len(job) < 3 {
+					return "", errors.New("Preset requires a name")
 				}
-				if is_gif { // force gif format
-					thumb_operation += "/f:gif"
+				for _, preset := range job[2:] {
+					if !presetRegex.MatchString(preset) {
+						return "", fmt.Errorf("Invalid preset name: %q", preset)
+					}
 				}
+				operations = append(operations, "preset:"+strings.Join(job[2:], ":"))
+			}
+		}
+	}
+	if err := checkZoomDimensions(config, resize_width, resize_height, zoom_x, zoom_y, options.dpr); err != nil {
+		return "", err
+	}
+	// fetch-only jobs, nothing to process
+	if config.PassOriginalWhenNoProcessing && len(operations) == 0 && len(trim_operation) == 0 && len(options.format) == 0 && options.maxBytes == 0 && len(options.page) == 0 {
+		raw_ext := "" // base64 sources keep their own format
+		if len(source_format) > 0 {
+			raw_ext = "." + source_format
+		}
+		signer.start(buffer)
+		buffer.WriteString("/raw:1")
+		if len(options.filename) > 0 { // raw mode still names downloads
+			buffer.WriteString("/" + filenameOperation(options.filename))
+		}
+		buffer.WriteString(sourceSegment(config.SourceURLMode, source_url, raw_ext))
+		return signer.url(buffer), nil
+	}
+	if format_quality := formatQuality(config); len(format_quality) > 0 {
+		operations = append(operations, format_quality)
+	}
+	if config.StripMetadata {
+		operations = append(operations, "sm:1")
+	}
+	if config.AutoRotate {
+		operations = append(operations, "ar:1")
+	} else {
+		operations = append(operations, "ar:0")
+	}
+	if len(config.SkipProcessingFormats) > 0 { // imgproxy returns these sources as is
+		operations = append(operations, "skp:"+strings.Join(config.SkipProcessingFormats, ":"))
+	}
+	if config.UseEmbeddedThumbnail {
+		operations = append(operations, "eth:1")
+	}
+	if options.dpr > 0 && is_resized {
+		operations = append(operations, "dpr:"+strconv.FormatFloat(options.dpr, 'f', -1, 64))
+	}
+	if len(config.ResizingAlgorithm) > 0 && is_resized {
+		operations = append(operations, "ra:"+config.ResizingAlgorithm)
+	}
+	if options.extend && is_resized { // pad to the requested size
+		// extend takes any gravity but smart, which centers like ce, the
+		// focus point only applies to fills
+		extend_gravity := config.Gravity
+		if extend_gravity == "sm" || len(extend_gravity) == 0 {
+			extend_gravity = "ce"
+		}
+		operations = append(operations, "ex:1:"+extend_gravity)
+	}
+	if options.maxBytes > 0 {
+		operations = append(operations, "mb:"+strconv.Itoa(options.maxBytes))
+	}
+	if len(options.page) > 0 { // pdf, tiff and other multi-page sources
+		operations = append(operations, "pg:"+options.page)
+	}
+	if len(options.filename) > 0 {
+		operations = append(operations, filenameOperation(options.filename))
+	}
+	// empty output format leaves it to imgproxy
+	output_format := ""
+	if len(options.format) > 0 { // explicitly forced format
+		output_format = options.format
+	} else if is_gif && is_resized { // force gif format
+		output_format = "gif"
+	} else if len(source_format) > 0 && skipsProcessing(config, source_format) {
+		// imgproxy only skips processing when the output keeps the source
+		// format, so Accept negotiation mustn't pick another one
+		output_format = source_format
+	} else if is_avif && is_resized && config.ForceAvifFormat { // force avif format
+		output_format = "avif"
+	} else if options.avif && !is_gif && !is_svg { // PreferAvif, gif and svg keep their format
+		output_format = "avif"
+	}
+	source_ext := "" // base64 sources carry the format as their extension instead
+	if config.SourceURLMode == "base64" && len(output_format) > 0 {
+		source_ext = "." + output_format
+	} else if config.SourceURLMode == "base64" && len(source_format) > 0 {
+		source_ext = "." + source_format
+	} else if len(output_format) > 0 {
+		operations = append(operations, "f:"+output_format)
+	}
+	signer.start(buffer)
+	if len(config.DefaultPreset) > 0 {
+		buffer.WriteString("/preset:" + config.DefaultPreset)
+	}
+	if len(trim_operation) > 0 {
+		buffer.WriteString("/" + trim_operation)
+	}
+	for _, operation := range operations {
+		buffer.WriteString("/" + operation)
+	}
+	buffer.WriteString(sourceSegment(config.SourceURLMode, source_url, source_ext))
+	return signer.url(buffer), nil
+}
+
+// imgproxy url signature state, the key and salt decoded once
+type imgproxySigner struct {
+	key  *hmacKey // HMAC-SHA256 of ImgproxyKey
+	salt []byte
+}
+
+// Signer for ImgproxyKey and ImgproxySalt, nil when neither is set
+func newImgproxySigner(config *Config) (*imgproxySigner, error) {
+	if len(config.ImgproxyKey) == 0 && len(config.ImgproxySalt) == 0 {
+		return nil, nil
+	}
+	if len(config.ImgproxyKey) == 0 || len(config.ImgproxySalt) == 0 {
+		return nil, errors.New("ImgproxyKey and ImgproxySalt must be set together")
+	}
+	key, err := hex.DecodeString(config.ImgproxyKey)
+	if err != nil {
+		return nil, fmt.Errorf("ImgproxyKey must be hex encoded: %w", err)
+	}
+	salt, err := hex.DecodeString(config.ImgproxySalt)
+	if err != nil {
+		return nil, fmt.Errorf("ImgproxySalt must be hex encoded: %w", err)
+	}
+	hmacKey, err := newHMACKey(string(key), "sha256")
+	if err != nil {
+		return nil, err
+	}
+	return &imgproxySigner{key: hmacKey, salt: salt}, nil
+}
+
+// Reset buffer for an imgproxy path, starting it with the salt the signature
+// covers, or /insecure for a nil signer
+func (s *imgproxySigner) start(buffer *bytes.Buffer) {
+	buffer.Reset()
+	if s == nil {
+		buffer.WriteString("/insecure")
+		return
+	}
+	buffer.Write(s.salt)
+}
+
+// imgproxy url of the path in buffer, prefixed with the base64url HMAC of
+// salt and path as imgproxy checks it
+func (s *imgproxySigner) url(buffer *bytes.Buffer) string {
+	if s == nil {
+		return buffer.String()
+	}
+	signature := base64.RawURLEncoding.EncodeToString(s.key.sum(buffer.Bytes()))
+	return "/" + signature + string(buffer.Bytes()[len(s.salt):])
+}
+
+// Jobs contain at least one process job
+func hasProcessJob(jobs [][]string) bool {
+	for _, job := range jobs {
+		if len(job) > 0 && job[0] == "p" {
+			return true
+		}
+	}
+	return false
+}
+
+// Split thumb jobs packing more operations as name and argument pairs,
+// ["p", "thumb", "400x300#", "crop", "100x100+0+0"], into one job each
+func expandJobs(jobs [][]string) ([][]string, error) {
+	expanded := make([][]string, 0, len(jobs))
+	for _, job := range jobs {
+		if len(job) < 4 || job[0] != "p" || job[1] != "thumb" {
+			expanded = append(expanded, job)
+			continue
+		}
+		if len(job)%2 != 1 {
+			return nil, fmt.Errorf("Invalid thumb job: %q, extra operations need a name and an argument", job)
+		}
+		expanded = append(expanded, job[:3])
+		for i := 3; i < len(job); i += 2 {
+			if !packedOperations[job[i]] {
+				return nil, fmt.Errorf("Invalid thumb job: %q, %q can't be packed into a thumb", job, job[i])
+			}
+			expanded = append(expanded, []string{"p", job[i], job[i+1]})
+		}
+	}
+	return expanded, nil
+}
+
+// Fetch path is already a full url, URLPrefix is not prepended
+func isAbsoluteSource(filePath string) bool {
+	lower := strings.ToLower(filePath)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://") || strings.HasPrefix(lower, "data:")
+}
+
+// Source url segment, /plain/<url> or /<base64url><ext> depending on mode,
+// ext is only added to base64 sources
+func sourceSegment(mode string, source_url string, ext string) string {
+	if mode == "base64" {
+		return "/" + base64.RawURLEncoding.EncodeToString([]byte(source_url)) + ext
+	}
+	return "/plain/" + source_url
+}
+
+// Parse a thumb geometry into its thumbRegex match and imgproxy width and
+// height, checked against MaxWidth and MaxHeight at dpr
+func parseThumbGeometry(config *Config, geometry string, dpr float64) ([]string, string, string, error) {
+	match := thumbRegex.FindStringSubmatch(geometry)
+	if len(match) < 1 || len(match[1])+len(match[2]) == 0 {
+		return nil, "", "", errors.New("Failed to extract job")
+	}
+	// gravity offsets, 400x300#+10+20, only for fill
+	if len(match[4]) > 0 && match[3] != "#" {
+		return nil, "", "", fmt.Errorf("Offsets are only supported with #: %q", geometry)
+	}
+	width, err := parseDimension(match[1])
+	if err != nil {
+		return nil, "", "", err
+	}
+	height, err := parseDimension(match[2])
+	if err != nil {
+		return nil, "", "", err
+	}
+	if err := checkMaxDimensions(config, width, height, dpr); err != nil {
+		return nil, "", "", err
+	}
+	return match, width, height, nil
+}
+
+// Parse a thumb dimension, imgproxy takes 0 as auto for an empty one
+func parseDimension(dimension string) (string, error) {
+	if len(dimension) == 0 {
+		return "0", nil
+	}
+	value, err := strconv.Atoi(dimension)
+	if err != nil || value < 1 || value > maxDimension {
+		return "", fmt.Errorf("Invalid dimension: %q, must be between 1 and %d", dimension, maxDimension)
+	}
+	return strconv.Itoa(value), nil
+}
+
+// Source format is one of SkipProcessingFormats
+func skipsProcessing(config *Config, format string) bool {
+	for _, skipped := range config.SkipProcessingFormats {
+		if skipped == format {
+			return true
+		}
+	}
+	return false
+}
+
+// Check thumb dimensions against MaxWidth and MaxHeight, multiplied by dpr as
+// imgproxy does, 0 for no dpr
+func checkMaxDimensions(config *Config, width string, height string, dpr float64) error {
+	if dpr == 0 {
+		dpr = 1
+	}
+	if config.MaxWidth > 0 {
+		if w, err := strconv.Atoi(width); err != nil || float64(w)*dpr > float64(config.MaxWidth) {
+			return fmt.Errorf("Width %s at dpr %g exceeds the maximum of %d", width, dpr, config.MaxWidth)
+		}
+	}
+	if config.MaxHeight > 0 {
+		if h, err := strconv.Atoi(height); err != nil || float64(h)*dpr > float64(config.MaxHeight) {
+			return fmt.Errorf("Height %s at dpr %g exceeds the maximum of %d", height, dpr, config.MaxHeight)
+		}
+	}
+	return nil
+}
+
+// Generate imgproxy format quality option from config, empty when unset
+func formatQuality(config *Config) string {
+	format_quality := ""
+	if config.JpegQuality > 0 {
+		format_quality += ":jpg:" + strconv.Itoa(config.JpegQuality)
+	}
+	if config.WebpQuality > 0 {
+		format_quality += ":webp:" + strconv.Itoa(config.WebpQuality)
+	}
+	if len(format_quality) == 0 {
+		return ""
+	}
+	return "fq" + format_quality
+}
+
+// Generate imgproxy crop option from WxH+X+Y geometry, offsets from the top left,
+// in pixels or as fractions of the image like 0.5x0.5+0.25+0.25
+func cropOperation(geometry string) (string, error) {
+	match := cropRegex.FindStringSubmatch(geometry)
+	if len(match) < 1 {
+		return "", fmt.Errorf("Invalid crop geometry: %q", geometry)
+	}
+	// a decimal point makes a value a fraction of the image, imgproxy reads
+	// values below 1 as relative so fractions must stay below 1
+	for i, value := range match[1:] {
+		if !strings.Contains(value, ".") {
+			continue
+		}
+		fraction, err := strconv.ParseFloat(value, 64)
+		if err != nil || fraction >= 1 {
+			return "", fmt.Errorf("Invalid crop geometry: %q, fractions must be below 1", geometry)
+		}
+		match[i+1] = strconv.FormatFloat(fraction, 'f', -1, 64)
+	}
+	if len(match[3]) == 0 { // no offsets, crop from the center
+		return "c:" + match[1] + ":" + match[2], nil
+	}
+	return "c:" + match[1] + ":" + match[2] + ":nowe:" + match[3] + ":" + match[4], nil
+}
+
+// Generate imgproxy filename option, base64url encoded so any character is
+// safe in the path
+func filenameOperation(filename string) string {
+	return "fn:" + base64.RawURLEncoding.EncodeToString([]byte(filename)) + ":1"
+}
+
+// Generate imgproxy zoom option from one or two positive factors, x then y,
+// the x and y factors are returned for checkZoomDimensions
+func zoomOperation(args []string) (string, float64, float64, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return "", 0, 0, errors.New("Zoom requires 1 or 2 factors")
+	}
+	operation := "zoom"
+	factors := []float64{}
+	for _, factor := range args {
+		value, err := strconv.ParseFloat(factor, 64)
+		if err != nil || !(value > 0 && value <= maxZoom) {
+			return "", 0, 0, fmt.Errorf("Invalid zoom factor: %q, must be above 0 and at most %d", factor, maxZoom)
+		}
+		factors = append(factors, value)
+		operation += ":" + strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	// a single factor zooms both axes
+	return operation, factors[0], factors[len(factors)-1], nil
+}
+
+// Zooming multiplies the resized dimensions, check the zoomed ones, times
+// dpr, against MaxWidth and MaxHeight. Without a resized dimension the output
+// size is unknown, so a limited axis can't be zoomed in.
+func checkZoomDimensions(config *Config, width int, height int, zoom_x float64, zoom_y float64, dpr float64) error {
+	if dpr == 0 {
+		dpr = 1
+	}
+	if config.MaxWidth > 0 && zoom_x > 1 && (width == 0 || float64(width)*zoom_x*dpr > float64(config.MaxWidth)) {
+		return fmt.Errorf("Zoomed width exceeds the maximum of %d", config.MaxWidth)
+	}
+	if config.MaxHeight > 0 && zoom_y > 1 && (height == 0 || float64(height)*zoom_y*dpr > float64(config.MaxHeight)) {
+		return fmt.Errorf("Zoomed height exceeds the maximum of %d", config.MaxHeight)
+	}
+	return nil
+}
+
+// Generate imgproxy watermark option from job arguments
+// opacity[, position[, x_offset[, y_offset]]]
+func watermarkOperation(args []string) (string, error) {
+	if len(args) < 1 || len(args) > 4 {
+		return "", errors.New("Watermark requires 1 to 4 arguments")
+	}
+	opacity, err := strconv.ParseFloat(args[0], 64)
+	if err != nil || !(opacity >= 0 && opacity <= 1) {
+		return "", fmt.Errorf("Invalid watermark opacity: %q, must be between 0 and 1", args[0])
+	}
+	options := []string{strconv.FormatFloat(opacity, 'f', -1, 64)}
+	if len(args) > 1 { // gravity without smart, or re to replicate the watermark
+		if position := args[1]; (!gravities[position] || position == "sm") && position != "re" {
+			return "", fmt.Errorf("Invalid watermark position: %q", position)
+		}
+		options = append(options, args[1])
+	}
+	if len(args) > 2 {
+		for _, offset := range args[2:] {
+			value, err := strconv.ParseFloat(offset, 64)
+			if err != nil || math.IsInf(value, 0) || math.IsNaN(value) {
+				return "", fmt.Errorf("Invalid watermark offset: %q", offset)
+			}
+			options = append(options, strconv.FormatFloat(value, 'f', -1, 64))
+		}
+	}
+	return "wm:" + strings.Join(options, ":"), nil
+}
+
+// Generate imgproxy padding option, 1 to 4 values in css order
+// top[, right[, bottom[, left]]]
+func padOperation(args []string) (string, error) {
+	if len(args) < 1 || len(args) > 4 {
+		return "", errors.New("Pad requires 1 to 4 values")
+	}
+	operation := "pd"
+	for _, padding := range args {
+		value, err := strconv.Atoi(padding)
+		if err != nil || value < 0 {
+			return "", fmt.Errorf("Invalid padding: %q", padding)
+		}
+		operation += ":" + strconv.Itoa(value)
+	}
+	return operation, nil
+}
+
+// Generate imgproxy pixelate option from a positive block size in pixels
+func pixelateOperation(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("Pixelate requires a block size")
+	}
+	size, err := strconv.Atoi(args[0])
+	if err != nil || size < 1 {
+		return "", fmt.Errorf("Invalid pixelate size: %q", args[0])
+	}
+	return "pix:" + strconv.Itoa(size), nil
+}
+
+// Generate imgproxy adjustment option, brightness from -255 to 255, contrast
+// and saturation from 0 to maxAdjustmentFactor
+func adjustmentOperation(name string, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("Adjustment %s requires a value", name)
+	}
+	adjustment := adjustments[name]
+	value, err := strconv.ParseFloat(args[0], 64)
+	if err != nil || !(value >= adjustment.min && value <= adjustment.max) {
+		return "", fmt.Errorf("Invalid %s: %q, must be between %g and %g", name, args[0], adjustment.min, adjustment.max)
+	}
+	if name == "brightness" && value != math.Trunc(value) {
+		return "", fmt.Errorf("Invalid brightness: %q, must be a whole number", args[0])
+	}
+	return adjustment.option + ":" + strconv.FormatFloat(value, 'f', -1, 64), nil
+}
+
+// Generate imgproxy trim option from job arguments
+// threshold[, color[, equal_hor[, equal_ver]]]
+func trimOperation(args []string) (string, error) {
+	if len(args) < 1 || len(args) > 4 {
+		return "", errors.New("Trim requires 1 to 4 arguments")
+	}
+	threshold, err := strconv.ParseFloat(args[0], 64)
+	if err != nil || !(threshold >= 0 && threshold <= maxTrimThreshold) {
+		return "", fmt.Errorf("Invalid trim threshold: %q, must be between 0 and %d", args[0], maxTrimThreshold)
+	}
+	// imgproxy gets the number as written here, not 1e1 or 0xa
+	options := append([]string{strconv.FormatFloat(threshold, 'f', -1, 64)}, args[1:]...)
+	if len(args) > 1 && args[1] != "" { // empty color lets imgproxy detect it
+		if !trimColorRegex.MatchString(args[1]) {
+			return "", fmt.Errorf("Invalid trim color: %q", args[1])
+		}
+	}
+	if len(args) > 2 { // equal_hor, equal_ver
+		for _, flag := range args[2:] {
+			if _, err := strconv.ParseBool(flag); err != nil {
+				return "", fmt.Errorf("Invalid trim equal flag: %q", flag)
 			}
 		}
 	}
-	return "/insecure" + thumb_operation + imgproxy_url
+	return "trim:" + strings.Join(options, ":"), nil
+}
+
+// HMAC hash keyed with secret, sha256 for an unknown algorithm
+func hmacHash(secret string, algorithm string) hash.Hash {
+	newHash, ok := hashAlgorithms[algorithm]
+	if !ok {
+		newHash = sha256.New
+	}
+	return hmac.New(newHash, []byte(secret))
+}
+
+// HMAC key of one secret, RFC 2104, with the hash states after the inner and
+// outer padded keys computed once, each sum restores copies of them instead
+// of hashing the padded key again like hmac.New
+type hmacKey struct {
+	inner, outer []byte    // marshaled hash states
+	pairs        sync.Pool // *hashPair restored from inner and outer per sum
+}
+
+// inner and outer hash of one HMAC sum
+type hashPair struct {
+	inner, outer hash.Hash
 }
 
-// calculateSHA
-func calculateSHA(secret string, jobs [][]string) string {
-	message := ""
+// Hash the padded keys of secret, sha256 for an unknown algorithm
+func newHMACKey(secret string, algorithm string) (*hmacKey, error) {
+	newHash, ok := hashAlgorithms[algorithm]
+	if !ok {
+		newHash = sha256.New
+	}
+	key := []byte(secret)
+	blockSize := newHash().BlockSize()
+	if len(key) > blockSize { // long keys are hashed first
+		h := newHash()
+		h.Write(key)
+		key = h.Sum(nil)
+	}
+	ipad := make([]byte, blockSize)
+	opad := make([]byte, blockSize)
+	copy(ipad, key)
+	copy(opad, key)
+	for i := range ipad {
+		ipad[i] ^= 0x36
+		opad[i] ^= 0x5c
+	}
+	states := [2][]byte{}
+	for i, pad := range [][]byte{ipad, opad} {
+		h := newHash()
+		h.Write(pad)
+		marshaler, ok := h.(encoding.BinaryMarshaler)
+		if !ok {
+			return nil, fmt.Errorf("HashAlgorithm %q can't save its state", algorithm)
+		}
+		state, err := marshaler.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		states[i] = state
+	}
+	k := &hmacKey{inner: states[0], outer: states[1]}
+	k.pairs.New = func() interface{} { return &hashPair{inner: newHash(), outer: newHash()} }
+	return k, nil
+}
+
+// HMAC of message, the same digest hmac.New gives for the secret
+func (k *hmacKey) sum(message []byte) []byte {
+	pair := k.pairs.Get().(*hashPair)
+	defer k.pairs.Put(pair)
+	// the states were marshaled by the same hash type, restoring can't fail
+	pair.inner.(encoding.BinaryUnmarshaler).UnmarshalBinary(k.inner)
+	pair.inner.Write(message)
+	pair.outer.(encoding.BinaryUnmarshaler).UnmarshalBinary(k.outer)
+	pair.outer.Write(pair.inner.Sum(nil))
+	return pair.outer.Sum(nil)
+}
+
+// calculateSHA with the named hash algorithm, truncated to length hex characters
+func calculateSHA(secret string, jobs [][]string, algorithm string, length int) string {
+	h := hmacHash(secret, algorithm)
+	h.Write(jobsMessage(jobs))
+	return hexSignature(h.Sum(nil), length)
+}
+
+// Signed message of jobs, as dragonfly signs them every element of every job
+// concatenated in order, so extra arguments and packed operations are covered
+func jobsMessage(jobs [][]string) []byte {
+	var message bytes.Buffer
 	for _, job := range jobs {
-		if job[0] == "f" { // fetch + url
-			message += "f" + job[1]
-		} else if job[0] == "p" { // process + thumb + size
-			message += "p" + job[1] + job[2]
+		for _, element := range job {
+			message.WriteString(element)
 		}
 	}
-	// calculate
-	h := hmac.New(sha256.New, []byte(secret))
-	h.Write([]byte(message))
-	digest := h.Sum(nil)
+	return message.Bytes()
+}
+
+// Hex HMAC digest truncated to length characters
+func hexSignature(digest []byte, length int) string {
 	shaHex := fmt.Sprintf("%x", digest)
-	log.Println("message:", message)
-	log.Println("calculated sha:", shaHex[:16])
-	return shaHex[:16]
+	// never log message or digest, they are enough to forge/replay urls
+	return shaHex[:length]
 }
@@ -0,0 +1,2703 @@
+package dragonfly2imgproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testSecret = "secret"
+	testPrefix = "https://images.example.com/"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard) // read with captureLog
+	os.Exit(m.Run())
+}
+
+// log output written while fn runs
+func captureLog(fn func()) string {
+	var buffer bytes.Buffer
+	previous := log.Writer()
+	log.SetOutput(&buffer)
+	defer log.SetOutput(previous)
+	fn()
+	return buffer.String()
+}
+
+// records the request forwarded by the middleware
+type nextHandler struct {
+	called bool
+	req    *http.Request
+}
+
+func (n *nextHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	n.called = true
+	n.req = req
+	rw.WriteHeader(http.StatusOK)
+}
+
+func testConfig() *Config {
+	config := CreateConfig()
+	config.DragonflySecret = testSecret
+	config.URLPrefix = testPrefix
+	config.StripMetadata = false // on by default, tested on its own
+	return config
+}
+
+// handler built from testConfig changed by configure, configure may be nil
+func newTestHandler(t testing.TB, configure func(*Config)) (http.Handler, *nextHandler) {
+	t.Helper()
+	config := testConfig()
+	if configure != nil {
+		configure(config)
+	}
+	next := &nextHandler{}
+	handler, err := New(context.Background(), next, config, "test")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return handler, next
+}
+
+// dragonfly url of jobs signed with secret
+func signedURL(t testing.TB, secret string, jobs [][]string, ext string) string {
+	t.Helper()
+	payload, err := json.Marshal(jobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "/media/" + base64.RawURLEncoding.EncodeToString(payload) + ext + "?sha=" + CalculateSHA(secret, jobs)
+}
+
+// url of jobs with an exp query parameter, signed as an extra ["e", exp] job
+func expiringURL(t testing.TB, jobs [][]string, ext string, exp string) string {
+	t.Helper()
+	signed := append(append([][]string{}, jobs...), []string{"e", exp})
+	return withSHA(signedURL(t, testSecret, jobs, ext), CalculateSHA(testSecret, signed)) + "&exp=" + exp
+}
+
+// target with its sha query value replaced by sha
+func withSHA(target string, sha string) string {
+	return target[:strings.Index(target, "?sha=")] + "?sha=" + sha
+}
+
+func serve(handler http.Handler, target string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+	return rw
+}
+
+// ServeHTTP case, want is the path forwarded to next, empty when the request
+// is answered without calling next
+type serveTest struct {
+	name   string
+	target string
+	header http.Header
+	status int
+	want   string
+}
+
+func testServe(t *testing.T, configure func(*Config), tests []serveTest) {
+	t.Helper()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler, next := newTestHandler(t, configure)
+			rw := serve(handler, test.target, test.header)
+			if rw.Code != test.status {
+				t.Fatalf("status %d, want %d, body %q", rw.Code, test.status, rw.Body.String())
+			}
+			forwarded := ""
+			if next.called {
+				forwarded = next.req.URL.EscapedPath()
+			}
+			if forwarded != test.want {
+				t.Errorf("forwarded %q, want %q", forwarded, test.want)
+			}
+		})
+	}
+}
+
+// generate_imgproxy_url case, want is empty when wantErr
+type urlTest struct {
+	name    string
+	jobs    [][]string
+	want    string
+	wantErr bool
+}
+
+// runs tests against testConfig changed by configure, configure may be nil
+func testURLs(t *testing.T, configure func(*Config), tests []urlTest) {
+	t.Helper()
+	config := testConfig()
+	if configure != nil {
+		configure(config)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := generate_imgproxy_url(config, test.jobs, requestOptions{})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error %v, want error %v", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTrim(t *testing.T) {
+	fetch := []string{"f", "scans/receipt.png"}
+	testURLs(t, nil, []urlTest{
+		{"threshold", [][]string{fetch, {"p", "trim", "10"}}, "/insecure/trim:10/ar:1/plain/https://images.example.com/scans/receipt.png", false},
+		{"all parameters", [][]string{fetch, {"p", "trim", "10", "ffffff", "1", "0"}}, "/insecure/trim:10:ffffff:1:0/ar:1/plain/https://images.example.com/scans/receipt.png", false},
+		{"detected color", [][]string{fetch, {"p", "trim", "2.5", "", "true", "false"}}, "/insecure/trim:2.5::true:false/ar:1/plain/https://images.example.com/scans/receipt.png", false},
+		{"exponent threshold", [][]string{fetch, {"p", "trim", "1e1"}}, "/insecure/trim:10/ar:1/plain/https://images.example.com/scans/receipt.png", false},
+		{"negative threshold", [][]string{fetch, {"p", "trim", "-1"}}, "", true},
+		{"threshold too large", [][]string{fetch, {"p", "trim", "256"}}, "", true},
+		{"not a number", [][]string{fetch, {"p", "trim", "NaN"}}, "", true},
+		{"infinite", [][]string{fetch, {"p", "trim", "Inf"}}, "", true},
+		{"invalid color", [][]string{fetch, {"p", "trim", "10", "white"}}, "", true},
+		{"invalid flag", [][]string{fetch, {"p", "trim", "10", "ffffff", "maybe"}}, "", true},
+		{"no threshold", [][]string{fetch, {"p", "trim"}}, "", true},
+		{"too many", [][]string{fetch, {"p", "trim", "10", "ffffff", "1", "0", "1"}}, "", true},
+	})
+}
+
+func TestLogsNoSignature(t *testing.T) {
+	const secret = "s3cr3t-value"
+	jobs := [][]string{{"f", "albums/beach.jpg"}, {"p", "thumb", "640x480#"}}
+	sha := CalculateSHA(secret, jobs)
+	valid := signedURL(t, secret, jobs, ".jpg")
+	tests := []struct {
+		name   string
+		target string
+		want   int
+	}{
+		{"valid sha", valid, http.StatusOK},
+		{"wrong sha", strings.Replace(valid, sha, "0123456789abcdef", 1), http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler, _ := newTestHandler(t, func(config *Config) { config.DragonflySecret = secret })
+			var rw *httptest.ResponseRecorder
+			output := captureLog(func() { rw = serve(handler, test.target, nil) })
+			if rw.Code != test.want {
+				t.Fatalf("status %d, want %d", rw.Code, test.want)
+			}
+			if len(output) == 0 {
+				t.Fatal("nothing logged")
+			}
+			if strings.Contains(output, sha) || strings.Contains(output, secret) {
+				t.Errorf("log contains the sha or secret: %q", output)
+			}
+		})
+	}
+}
+
+func TestSingleJobShape(t *testing.T) {
+	jobs := [][]string{{"f", "brand/logo.png"}}
+	single := "/media/" + base64.RawURLEncoding.EncodeToString([]byte(`["f","brand/logo.png"]`)) + ".png?sha=" + CalculateSHA(testSecret, jobs)
+	testServe(t, func(config *Config) { config.AllowSingleJobShape = true }, []serveTest{
+		{"single job", single, nil, http.StatusOK, "/insecure/ar:1/plain/https://images.example.com/brand/logo.png"},
+		{"array of jobs", signedURL(t, testSecret, jobs, ".png"), nil, http.StatusOK, "/insecure/ar:1/plain/https://images.example.com/brand/logo.png"},
+	})
+	testServe(t, nil, []serveTest{
+		{"single job not allowed", single, nil, http.StatusBadRequest, ""},
+		{"array of jobs", signedURL(t, testSecret, jobs, ".png"), nil, http.StatusOK, "/insecure/ar:1/plain/https://images.example.com/brand/logo.png"},
+	})
+}
+
+func TestStackedResizes(t *testing.T) {
+	fetch := []string{"f", "catalog/chair.jpg"}
+	testURLs(t, nil, []urlTest{
+		{"fit then fill", [][]string{fetch, {"p", "thumb", "800x600>"}, {"p", "thumb", "400x300#"}}, "/insecure/rs:fit:800:600:0/rs:fill:400:300:g:ce/ar:1/plain/https://images.example.com/catalog/chair.jpg", false},
+		{"fill then fit", [][]string{fetch, {"p", "thumb", "400x300#"}, {"p", "thumb", "800x600>"}}, "/insecure/rs:fill:400:300:g:ce/rs:fit:800:600:0/ar:1/plain/https://images.example.com/catalog/chair.jpg", false},
+		{"trim between resizes", [][]string{fetch, {"p", "thumb", "800x600"}, {"p", "trim", "5"}, {"p", "thumb", "200x"}}, "/insecure/trim:5/rs:fit:800:600/rs:fit:200:0/ar:1/plain/https://images.example.com/catalog/chair.jpg", false},
+		{"gif forced once", [][]string{{"f", "loops/spinner.gif"}, {"p", "thumb", "64x64"}, {"p", "thumb", "32x32"}}, "/insecure/rs:fit:64:64/rs:fit:32:32/ar:1/f:gif/plain/https://images.example.com/loops/spinner.gif", false},
+	})
+}
+
+func TestDecodeBase64(t *testing.T) {
+	payload := []byte(`[["f","press/kit>>.png"]]`) // + and padding in standard base64
+	tests := []struct {
+		name    string
+		encoded string
+		wantErr bool
+	}{
+		{"raw url", base64.RawURLEncoding.EncodeToString(payload), false},
+		{"standard", base64.StdEncoding.EncodeToString(payload), false},
+		{"raw standard", base64.RawStdEncoding.EncodeToString(payload), false},
+		{"invalid", "not*base64", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decoded, err := decodeBase64(test.encoded)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error %v, want error %v", err, test.wantErr)
+			}
+			if !test.wantErr && !bytes.Equal(decoded, payload) {
+				t.Errorf("decoded %s, want %s", decoded, payload)
+			}
+		})
+	}
+
+	sha := CalculateSHA(testSecret, [][]string{{"f", "press/kit>>.png"}})
+	testServe(t, nil, []serveTest{
+		{"standard base64 url", "/media/" + base64.StdEncoding.EncodeToString(payload) + ".png?sha=" + sha, nil, http.StatusOK, "/insecure/ar:1/plain/https://images.example.com/press/kit%3E%3E.png"},
+	})
+}
+
+func TestShaWhitespace(t *testing.T) {
+	signed := signedURL(t, testSecret, [][]string{{"f", "team/portrait.jpeg"}, {"p", "thumb", "120x120#"}}, ".jpeg")
+	const want = "/insecure/rs:fill:120:120:g:ce/ar:1/plain/https://images.example.com/team/portrait.jpeg"
+	testServe(t, nil, []serveTest{
+		{"trailing space", signed + "%20", nil, http.StatusOK, want},
+		{"trailing newline", signed + "%0A", nil, http.StatusOK, want},
+		{"trailing crlf", signed + "%0D%0A", nil, http.StatusOK, want},
+		{"leading tab", strings.Replace(signed, "?sha=", "?sha=%09", 1), nil, http.StatusOK, want},
+		{"whitespace only", signed[:strings.Index(signed, "?sha=")] + "?sha=%20%0A", nil, http.StatusBadRequest, ""},
+		{"extra character", signed + "0", nil, http.StatusForbidden, ""},
+	})
+
+	handler, _ := newTestHandler(t, nil)
+	if output := captureLog(func() { serve(handler, signed+"%0A", nil) }); !strings.Contains(output, "Trimmed") {
+		t.Errorf("no warning logged for a trimmed sha: %q", output)
+	}
+}
+
+func TestFormatByPathRegex(t *testing.T) {
+	routes := func(config *Config) {
+		config.FormatByPathRegex = map[string]string{`\.jpg$`: "webp", `\.png$`: "PNG"}
+	}
+	testServe(t, routes, []serveTest{
+		{"webp route", signedURL(t, testSecret, [][]string{{"f", "menu/pasta.jpg"}}, ".jpg"), nil, http.StatusOK, "/insecure/ar:1/f:webp/plain/https://images.example.com/menu/pasta.jpg"},
+		{"upper case format", signedURL(t, testSecret, [][]string{{"f", "menu/pasta.jpg"}, {"p", "thumb", "300x"}}, ".png"), nil, http.StatusOK, "/insecure/rs:fit:300:0/ar:1/f:png/plain/https://images.example.com/menu/pasta.jpg"},
+		{"overrides gif", signedURL(t, testSecret, [][]string{{"f", "menu/steam.gif"}, {"p", "thumb", "300x"}}, ".jpg"), nil, http.StatusOK, "/insecure/rs:fit:300:0/ar:1/f:webp/plain/https://images.example.com/menu/steam.gif"},
+		{"no route", signedURL(t, testSecret, [][]string{{"f", "menu/pasta.jpg"}}, ".webp"), nil, http.StatusOK, "/insecure/ar:1/plain/https://images.example.com/menu/pasta.jpg"},
+	})
+
+	for _, invalid := range []map[string]string{{`(`: "webp"}, {`\.jpg$`: "bmp"}} {
+		config := testConfig()
+		config.FormatByPathRegex = invalid
+		if _, err := New(context.Background(), &nextHandler{}, config, "test"); err == nil {
+			t.Errorf("New accepted FormatByPathRegex %v", invalid)
+		}
+	}
+}
+
+func TestUppercaseExtensions(t *testing.T) {
+	still := [][]string{{"f", "uploads/IMG_0042.JPG"}, {"p", "thumb", "1024x768>"}}
+	animated := [][]string{{"f", "uploads/Confetti.GIF"}, {"p", "thumb", "200x"}}
+	testServe(t, nil, []serveTest{
+		{"JPG", signedURL(t, testSecret, still, ".JPG"), nil, http.StatusOK, "/insecure/rs:fit:1024:768:0/ar:1/plain/https://images.example.com/uploads/IMG_0042.JPG"},
+		{"Jpeg", signedURL(t, testSecret, still, ".Jpeg"), nil, http.StatusOK, "/insecure/rs:fit:1024:768:0/ar:1/plain/https://images.example.com/uploads/IMG_0042.JPG"},
+		{"SVG", signedURL(t, testSecret, [][]string{{"f", "brand/Mark.SVG"}}, ".SVG"), nil, http.StatusOK, "/insecure/ar:1/plain/https://images.example.com/brand/Mark.SVG"},
+		{"GIF source stays gif", signedURL(t, testSecret, animated, ".GIF"), nil, http.StatusOK, "/insecure/rs:fit:200:0/ar:1/f:gif/plain/https://images.example.com/uploads/Confetti.GIF"},
+	})
+}
+
+func TestSourceURLMode(t *testing.T) {
+	jobs := [][]string{{"f", "events/2024 gala.jpg"}, {"p", "thumb", "600x400#"}}
+	testURLs(t, func(config *Config) { config.SourceURLMode = "plain" }, []urlTest{
+		{"plain", jobs, "/insecure/rs:fill:600:400:g:ce/ar:1/plain/https://images.example.com/events/2024%20gala.jpg", false},
+	})
+	testURLs(t, func(config *Config) { config.SourceURLMode = "base64" }, []urlTest{
+		{"base64", jobs, "/insecure/rs:fill:600:400:g:ce/ar:1/" + base64.RawURLEncoding.EncodeToString([]byte("https://images.example.com/events/2024%20gala.jpg")) + ".jpg", false},
+	})
+
+	for mode, valid := range map[string]bool{"": true, "plain": true, "base64": true, "encoded": false} {
+		config := testConfig()
+		config.SourceURLMode = mode
+		if _, err := New(context.Background(), &nextHandler{}, config, "test"); (err == nil) != valid {
+			t.Errorf("SourceURLMode %q: error %v", mode, err)
+		}
+	}
+}
+
+func TestSourceTypePrefix(t *testing.T) {
+	for _, invalid := range []struct{ sourceType, prefix string }{
+		{"http", "/images/"},
+		{"", "images/"},
+		{"local", "https://images.example.com/"},
+		{"local", "images/"},
+		{"s3", "https://images.example.com/"},
+	} {
+		config := testConfig()
+		config.SourceType, config.URLPrefix = invalid.sourceType, invalid.prefix
+		if _, err := New(context.Background(), &nextHandler{}, config, "test"); err == nil {
+			t.Errorf("New accepted SourceType %q with URLPrefix %q", invalid.sourceType, invalid.prefix)
+		}
+	}
+
+	jobs := [][]string{{"f", "archive/scan.tiff"}, {"p", "thumb", "900x"}}
+	testServe(t, func(config *Config) { config.SourceType, config.URLPrefix = "local", "/srv/assets/" }, []serveTest{
+		{"local relative prefix", signedURL(t, testSecret, jobs, ""), nil, http.StatusOK, "/insecure/rs:fit:900:0/ar:1/plain/local:///srv/assets/archive/scan.tiff"},
+	})
+	testServe(t, func(config *Config) { config.SourceType = "http" }, []serveTest{
+		{"http prefix with host", signedURL(t, testSecret, jobs, ""), nil, http.StatusOK, "/insecure/rs:fit:900:0/ar:1/plain/https://images.example.com/archive/scan.tiff"},
+	})
+}
+
+func TestForceAvifFormat(t *testing.T) {
+	avif := []string{"f", "gallery/aurora.AVIF"}
+	testURLs(t, func(config *Config) { config.ForceAvifFormat = true }, []urlTest{
+		{"resized avif", [][]string{avif, {"p", "thumb", "1600x900>"}}, "/insecure/rs:fit:1600:900:0/ar:1/f:avif/plain/https://images.example.com/gallery/aurora.AVIF", false},
+		{"avif not resized", [][]string{avif}, "/insecure/ar:1/plain/https://images.example.com/gallery/aurora.AVIF", false},
+		{"resized png", [][]string{{"f", "gallery/aurora.png"}, {"p", "thumb", "1600x900>"}}, "/insecure/rs:fit:1600:900:0/ar:1/plain/https://images.example.com/gallery/aurora.png", false},
+	})
+	testURLs(t, nil, []urlTest{
+		{"negotiated by default", [][]string{avif, {"p", "thumb", "1600x900>"}}, "/insecure/rs:fit:1600:900:0/ar:1/plain/https://images.example.com/gallery/aurora.AVIF", false},
+	})
+}
+
+func TestNewValidatesURLPrefix(t *testing.T) {
+	for _, test := range []struct {
+		prefix  string
+		wantErr string
+	}{
+		{"", "URLPrefix required"},
+		{"https://images.example.com", ""},
+		{"images.example.com/", "must have a scheme and host"},
+		{"https:///uploads/", "must have a scheme and host"},
+		{"https://images.example.com/%zz/", "Invalid URLPrefix"},
+		{"https://images.example.com/uploads/", ""},
+	} {
+		config := testConfig()
+		config.URLPrefix = test.prefix
+		_, err := New(context.Background(), &nextHandler{}, config, "test")
+		if test.wantErr == "" && err != nil {
+			t.Errorf("URLPrefix %q: %v", test.prefix, err)
+		}
+		if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+			t.Errorf("URLPrefix %q: error %v, want %q", test.prefix, err, test.wantErr)
+		}
+	}
+}
+
+func TestURLPrefixTrailingSlash(t *testing.T) {
+	config := testConfig()
+	config.URLPrefix = "https://static.example.org/public"
+	handler, err := New(context.Background(), &nextHandler{}, config, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.URLPrefix != "https://static.example.org/public" {
+		t.Errorf("caller's URLPrefix changed to %q", config.URLPrefix)
+	}
+	if got := handler.(*Dragonfly2imgproxy).config.URLPrefix; got != "https://static.example.org/public/" {
+		t.Errorf("handler URLPrefix %q, want a trailing slash", got)
+	}
+
+	testServe(t, func(config *Config) { config.URLPrefix = "https://static.example.org/public" }, []serveTest{
+		{"prefix without slash", signedURL(t, testSecret, [][]string{{"f", "image.jpg"}}, ".jpg"), nil, http.StatusOK, "/insecure/ar:1/plain/https://static.example.org/public/image.jpg"},
+	})
+}
+
+func TestSourcePrefixes(t *testing.T) {
+	prefixes := func(config *Config) {
+		config.Prefixes = map[string]string{"cdn2": "https://cdn2.example.net/assets", "legacy": "https://old.example.com/"}
+	}
+	testURLs(t, func(config *Config) {
+		prefixes(config)
+		config.Prefixes["cdn2"] += "/" // New adds the slash
+	}, []urlTest{
+		{"default prefix", [][]string{{"f", "public/image.jpg"}}, "/insecure/ar:1/plain/https://images.example.com/public/image.jpg", false},
+		{"keyed prefix", [][]string{{"f", "cdn2", "public/image.jpg"}}, "/insecure/ar:1/plain/https://cdn2.example.net/assets/public/image.jpg", false},
+		{"unknown key", [][]string{{"f", "cdn3", "public/image.jpg"}}, "", true},
+		{"missing path", [][]string{{"f"}}, "", true},
+	})
+
+	keyed := [][]string{{"f", "legacy", "2019/header.png"}, {"p", "thumb", "1200x"}}
+	testServe(t, prefixes, []serveTest{
+		{"keyed prefix", signedURL(t, testSecret, keyed, ".png"), nil, http.StatusOK, "/insecure/rs:fit:1200:0/ar:1/plain/https://old.example.com/2019/header.png"},
+		{"prefix key is signed", withSHA(signedURL(t, testSecret, keyed, ".png"), CalculateSHA(testSecret, [][]string{{"f", "2019/header.png"}, {"p", "thumb", "1200x"}})), nil, http.StatusForbidden, ""},
+	})
+
+	config := testConfig()
+	prefixes(config)
+	if _, err := New(context.Background(), &nextHandler{}, config, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if config.Prefixes["cdn2"] != "https://cdn2.example.net/assets" {
+		t.Errorf("caller's Prefixes changed: %v", config.Prefixes)
+	}
+	config.Prefixes["cdn2"] = "cdn2.example.net/"
+	if _, err := New(context.Background(), &nextHandler{}, config, "test"); err == nil {
+		t.Error("prefix without a scheme accepted")
+	}
+}
+
+func TestSignedMessage(t *testing.T) {
+	// dragonfly signs the concatenation of every job element
+	for message, jobs := range map[string][][]string{
+		"fpublic/image.jpg":                {{"f", "public/image.jpg"}},
+		"fcdn2public/image.jpg":            {{"f", "cdn2", "public/image.jpg"}},
+		"fpublic/image.jpgpthumb300x200#":  {{"f", "public/image.jpg"}, {"p", "thumb", "300x200#"}},
+		"fpublic/image.jpgptrim10ffffff10": {{"f", "public/image.jpg"}, {"p", "trim", "10", "ffffff", "1", "0"}},
+	} {
+		mac := hmac.New(sha256.New, []byte(testSecret))
+		mac.Write([]byte(message))
+		if want := hex.EncodeToString(mac.Sum(nil))[:16]; CalculateSHA(testSecret, jobs) != want {
+			t.Errorf("CalculateSHA(%q) = %s, want HMAC of %q %s", jobs, CalculateSHA(testSecret, jobs), message, want)
+		}
+	}
+}
+
+func TestPresets(t *testing.T) {
+	avatar := []string{"f", "users/7/avatar.png"}
+	testURLs(t, nil, []urlTest{
+		{"preset job", [][]string{avatar, {"p", "preset", "sharp"}}, "/insecure/preset:sharp/ar:1/plain/https://images.example.com/users/7/avatar.png", false},
+		{"several presets", [][]string{avatar, {"p", "preset", "sharp", "round"}}, "/insecure/preset:sharp:round/ar:1/plain/https://images.example.com/users/7/avatar.png", false},
+		{"preset after resize", [][]string{avatar, {"p", "thumb", "96x96#"}, {"p", "preset", "Avatar2"}}, "/insecure/rs:fill:96:96:g:ce/preset:Avatar2/ar:1/plain/https://images.example.com/users/7/avatar.png", false},
+		{"no name", [][]string{avatar, {"p", "preset"}}, "", true},
+		{"empty name", [][]string{avatar, {"p", "preset", ""}}, "", true},
+		{"path in name", [][]string{avatar, {"p", "preset", "sharp/../raw"}}, "", true},
+		{"option in name", [][]string{avatar, {"p", "preset", "sharp:rs"}}, "", true},
+	})
+	testURLs(t, func(config *Config) { config.DefaultPreset = "web" }, []urlTest{
+		{"default preset", [][]string{avatar}, "/insecure/preset:web/ar:1/plain/https://images.example.com/users/7/avatar.png", false},
+		{"default preset comes first", [][]string{avatar, {"p", "preset", "sharp"}}, "/insecure/preset:web/preset:sharp/ar:1/plain/https://images.example.com/users/7/avatar.png", false},
+	})
+
+	signed := [][]string{avatar, {"p", "preset", "sharp"}}
+	testServe(t, nil, []serveTest{
+		{"preset is signed", withSHA(signedURL(t, testSecret, signed, ".png"), CalculateSHA(testSecret, [][]string{avatar})), nil, http.StatusForbidden, ""},
+	})
+
+	config := testConfig()
+	config.DefaultPreset = "web-large"
+	if _, err := New(context.Background(), &nextHandler{}, config, "test"); err == nil {
+		t.Error("New accepted DefaultPreset web-large")
+	}
+}
+
+func TestTrimBeforeResize(t *testing.T) {
+	scan := []string{"f", "scans/letterhead.png"}
+	testURLs(t, nil, []urlTest{
+		{"trim 10", [][]string{scan, {"p", "trim", "10"}}, "/insecure/trim:10/ar:1/plain/https://images.example.com/scans/letterhead.png", false},
+		{"trim with color", [][]string{scan, {"p", "trim", "10", "ffffff"}}, "/insecure/trim:10:ffffff/ar:1/plain/https://images.example.com/scans/letterhead.png", false},
+		{"trim after resize job", [][]string{scan, {"p", "thumb", "400x400#"}, {"p", "trim", "10"}}, "/insecure/trim:10/rs:fill:400:400:g:ce/ar:1/plain/https://images.example.com/scans/letterhead.png", false},
+		{"last trim wins", [][]string{scan, {"p", "trim", "10"}, {"p", "trim", "30", "000000"}}, "/insecure/trim:30:000000/ar:1/plain/https://images.example.com/scans/letterhead.png", false},
+		{"non numeric threshold", [][]string{scan, {"p", "trim", "ten"}}, "", true},
+	})
+	testURLs(t, func(config *Config) { config.DefaultPreset = "docs" }, []urlTest{
+		{"after the default preset", [][]string{scan, {"p", "thumb", "400x"}, {"p", "trim", "10"}}, "/insecure/preset:docs/trim:10/rs:fit:400:0/ar:1/plain/https://images.example.com/scans/letterhead.png", false},
+	})
+}
+
+func TestExtend(t *testing.T) {
+	boxed := signedURL(t, testSecret, [][]string{{"f", "products/mug.jpg"}, {"p", "thumb", "500x500>"}}, ".jpg")
+	original := signedURL(t, testSecret, [][]string{{"f", "products/mug.jpg"}}, ".jpg")
+	testServe(t, nil, []serveTest{
+		{"extend", boxed + "&extend=true", nil, http.StatusOK, "/insecure/rs:fit:500:500:0/ar:1/ex:1:ce/plain/https://images.example.com/products/mug.jpg"},
+		{"extend false", boxed + "&extend=false", nil, http.StatusOK, "/insecure/rs:fit:500:500:0/ar:1/plain/https://images.example.com/products/mug.jpg"},
+		{"not extended by default", boxed, nil, http.StatusOK, "/insecure/rs:fit:500:500:0/ar:1/plain/https://images.example.com/products/mug.jpg"},
+		{"nothing to extend", original + "&extend=true", nil, http.StatusOK, "/insecure/ar:1/plain/https://images.example.com/products/mug.jpg"},
+	})
+}
+
+func TestCaretGeometry(t *testing.T) {
+	hero := []string{"f", "landing/hero.jpg"}
+	testURLs(t, nil, []urlTest{
+		{"fill", [][]string{hero, {"p", "thumb", "1920x1080^"}}, "/insecure/rs:fill:1920:1080/ar:1/plain/https://images.example.com/landing/hero.jpg", false},
+		{"fill by width", [][]string{hero, {"p", "thumb", "1920x^"}}, "/insecure/rs:fill:1920:0/ar:1/plain/https://images.example.com/landing/hero.jpg", false},
+	})
+	testURLs(t, func(config *Config) { config.CaretAsMinDimensions = true }, []urlTest{
+		{"minimum dimensions", [][]string{hero, {"p", "thumb", "1920x1080^"}}, "/insecure/mw:1920/mh:1080/ar:1/plain/https://images.example.com/landing/hero.jpg", false},
+		{"minimum width", [][]string{hero, {"p", "thumb", "1920x^"}}, "/insecure/mw:1920/ar:1/plain/https://images.example.com/landing/hero.jpg", false},
+		{"other geometries unchanged", [][]string{hero, {"p", "thumb", "1920x1080#"}}, "/insecure/rs:fill:1920:1080:g:ce/ar:1/plain/https://images.example.com/landing/hero.jpg", false},
+		{"no geometry", [][]string{hero, {"p", "thumb"}}, "", true},
+	})
+
+	jobs := [][]string{hero, {"p", "thumb", "1920x1080^"}}
+	if CalculateSHA(testSecret, jobs) == CalculateSHA(testSecret, [][]string{hero, {"p", "thumb", "1920x1080"}}) {
+		t.Error("the ^ modifier is not signed")
+	}
+}
+
+func TestFormatParameter(t *testing.T) {
+	poster := signedURL(t, testSecret, [][]string{{"f", "films/poster.jpg"}, {"p", "thumb", "300x450#"}}, ".jpg")
+	sticker := signedURL(t, testSecret, [][]string{{"f", "films/clip.gif"}, {"p", "thumb", "300x"}}, ".gif")
+	testServe(t, nil, []serveTest{
+		{"webp", poster + "&format=webp", nil, http.StatusOK, "/insecure/rs:fill:300:450:g:ce/ar:1/f:webp/plain/https://images.example.com/films/poster.jpg"},
+		{"png", poster + "&format=png", nil, http.StatusOK, "/insecure/rs:fill:300:450:g:ce/ar:1/f:png/plain/https://images.example.com/films/poster.jpg"},
+		{"upper case", poster + "&format=AVIF", nil, http.StatusOK, "/insecure/rs:fill:300:450:g:ce/ar:1/f:avif/plain/https://images.example.com/films/poster.jpg"},
+		{"gif kept without format", sticker, nil, http.StatusOK, "/insecure/rs:fit:300:0/ar:1/f:gif/plain/https://images.example.com/films/clip.gif"},
+		{"explicit format over gif", sticker + "&format=webp", nil, http.StatusOK, "/insecure/rs:fit:300:0/ar:1/f:webp/plain/https://images.example.com/films/clip.gif"},
+		{"bmp", poster + "&format=bmp", nil, http.StatusBadRequest, ""},
+	})
+	testServe(t, func(config *Config) { config.FormatByPathRegex = map[string]string{`^/media/`: "jpg"} }, []serveTest{
+		{"over route format", poster + "&format=webp", nil, http.StatusOK, "/insecure/rs:fill:300:450:g:ce/ar:1/f:webp/plain/https://images.example.com/films/poster.jpg"},
+	})
+}
+
+func TestExpiry(t *testing.T) {
+	jobs := [][]string{{"f", "private/contract-scan.png"}, {"p", "thumb", "600x"}}
+	const want = "/insecure/rs:fit:600:0/ar:1/plain/https://images.example.com/private/contract-scan.png"
+	now := time.Now().Unix()
+	soon := strconv.FormatInt(now+300, 10)
+	testServe(t, func(config *Config) { config.ExpirySeconds = 900 }, []serveTest{
+		{"future", expiringURL(t, jobs, ".png", soon), nil, http.StatusOK, want},
+		{"past", expiringURL(t, jobs, ".png", strconv.FormatInt(now-1, 10)), nil, http.StatusForbidden, ""},
+		{"beyond ExpirySeconds", expiringURL(t, jobs, ".png", strconv.FormatInt(now+86400, 10)), nil, http.StatusForbidden, ""},
+		{"missing exp", signedURL(t, testSecret, jobs, ".png"), nil, http.StatusBadRequest, ""},
+		{"not a timestamp", expiringURL(t, jobs, ".png", "tomorrow"), nil, http.StatusBadRequest, ""},
+		{"extended exp", strings.Replace(expiringURL(t, jobs, ".png", soon), "&exp="+soon, "&exp="+strconv.FormatInt(now+600, 10), 1), nil, http.StatusForbidden, ""},
+	})
+	testServe(t, nil, []serveTest{
+		{"exp ignored when disabled", signedURL(t, testSecret, jobs, ".png") + "&exp=1", nil, http.StatusOK, want},
+	})
+
+	config := testConfig()
+	config.ExpirySeconds = -60
+	if _, err := New(context.Background(), &nextHandler{}, config, "test"); err == nil {
+		t.Error("New accepted a negative ExpirySeconds")
+	}
+}
+
+func TestSignatureLength(t *testing.T) {
+	jobs := [][]string{{"f", "maps/route-12.png"}, {"p", "thumb", "640x360#"}}
+	const want = "/insecure/rs:fill:640:360:g:ce/ar:1/plain/https://images.example.com/maps/route-12.png"
+	for _, length := range []int{16, 32, 64} {
+		sha := calculateSHA(testSecret, jobs, defaultHashAlgorithm, length)
+		if len(sha) != length || !strings.HasPrefix(sha, CalculateSHA(testSecret, jobs)) {
+			t.Fatalf("length %d: sha %q", length, sha)
+		}
+		target := withSHA(signedURL(t, testSecret, jobs, ".png"), sha)
+		testServe(t, func(config *Config) { config.SignatureLength = length }, []serveTest{
+			{strconv.Itoa(length), target, nil, http.StatusOK, want},
+			{strconv.Itoa(length) + " one short", target[:len(target)-1], nil, http.StatusForbidden, ""},
+			{strconv.Itoa(length) + " one extra", target + "0", nil, http.StatusForbidden, ""},
+		})
+	}
+	testServe(t, func(config *Config) { config.SignatureLength = 0 }, []serveTest{
+		{"zero is the default", signedURL(t, testSecret, jobs, ".png"), nil, http.StatusOK, want},
+	})
+
+	for _, length := range []int{-1, 65} {
+		config := testConfig()
+		config.SignatureLength = length
+		if _, err := New(context.Background(), &nextHandler{}, config, "test"); err == nil {
+			t.Errorf("New accepted SignatureLength %d", length)
+		}
+	}
+}
+
+func TestHashAlgorithms(t *testing.T) {
+	// HMAC of "fledger/receipt-0042.jpgpthumb200x" keyed with testSecret
+	jobs := [][]string{{"f", "ledger/receipt-0042.jpg"}, {"p", "thumb", "200x"}}
+	digests := map[string]string{
+		"sha1":   "2bddc478e01ee8fc38a0cc02412ea731af48f739",
+		"sha256": "6814960c729a62c80734b5081196f031b8c44f61815f63314b5f0a8cd769a135",
+		"sha512": "58b847822f4cbb5816c3b8d050d0367acc9d21da0fb6a9202fff3d35e5d8d3f51a7cd846884afcf12861d99f35b1b3d486665b29a665f27f3c79e21641a38580",
+	}
+	for algorithm, digest := range digests {
+		if sha := calculateSHA(testSecret, jobs, algorithm, len(digest)); sha != digest {
+			t.Errorf("%s: got %s, want %s", algorithm, sha, digest)
+		}
+		algorithm := algorithm
+		testServe(t, func(config *Config) { config.HashAlgorithm = algorithm }, []serveTest{
+			{algorithm, withSHA(signedURL(t, testSecret, jobs, ".jpg"), digest[:16]), nil, http.StatusOK, "/insecure/rs:fit:200:0/ar:1/plain/https://images.example.com/ledger/receipt-0042.jpg"},
+		})
+	}
+	testServe(t, func(config *Config) { config.HashAlgorithm = "sha1" }, []serveTest{
+		{"sha256 sha with sha1", withSHA(signedURL(t, testSecret, jobs, ".jpg"), digests["sha256"][:16]), nil, http.StatusForbidden, ""},
+	})
+
+	for _, invalid := range []struct {
+		algorithm string
+		length    int
+	}{{"md5", 16}, {"SHA256", 16}, {"sha1", 41}, {"sha512", 129}} {
+		config := testConfig()
+		config.HashAlgorithm, config.SignatureLength = invalid.algorithm, invalid.length
+		if _, err := New(context.Background(), &nextHandler{}, config, "test"); err == nil {
+			t.Errorf("New accepted HashAlgorithm %q with SignatureLength %d", invalid.algorithm, invalid.length)
+		}
+	}
+}
+
+func TestShaInPath(t *testing.T) {
+	jobs := [][]string{{"f", "blog/2024/cover.webp"}, {"p", "thumb", "1200x630#"}}
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`[["f","blog/2024/cover.webp"],["p","thumb","1200x630#"]]`))
+	sha := CalculateSHA(testSecret, jobs)
+	const want = "/insecure/rs:fill:1200:630:g:ce/ar:1/plain/https://images.example.com/blog/2024/cover.webp"
+	testServe(t, func(config *Config) { config.ShaInPath = true }, []serveTest{
+		{"path", "/media/" + payload + "/" + sha + ".webp", nil, http.StatusOK, want},
+		{"path upper case hex", "/media/" + payload + "/" + strings.ToUpper(sha) + ".webp", nil, http.StatusForbidden, ""},
+		{"path without extension", "/media/" + payload + "/" + sha, nil, http.StatusOK, want},
+		{"wrong sha", "/media/" + payload + "/0123456789abcdef.webp", nil, http.StatusForbidden, ""},
+		{"query layout", "/media/" + payload + ".webp?sha=" + sha, nil, http.StatusBadRequest, ""},
+	})
+	testServe(t, nil, []serveTest{
+		{"query", "/media/" + payload + ".webp?sha=" + sha, nil, http.StatusOK, want},
+		{"path layout", "/media/" + payload + "/" + sha + ".webp", nil, http.StatusBadRequest, ""},
+	})
+}
+
+func TestPassthroughParams(t *testing.T) {
+	target := signedURL(t, testSecret, [][]string{{"f", "docs/diagram.svg"}}, ".svg") + "&v=3&utm_source=mail&convert=false&format=png&v=4"
+	for _, test := range []struct {
+		name        string
+		passthrough []string
+		query       string
+	}{
+		{"dropped by default", nil, ""},
+		{"allowed keys kept", []string{"v"}, "v=3&v=4"},
+		{"several keys", []string{"utm_source", "v"}, "utm_source=mail&v=3&v=4"},
+		{"middleware keys never kept", []string{"sha", "convert", "format", "v"}, "v=3&v=4"},
+		{"absent key", []string{"cachebust"}, ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			handler, next := newTestHandler(t, func(config *Config) { config.PassthroughParams = test.passthrough })
+			if rw := serve(handler, target, nil); rw.Code != http.StatusOK {
+				t.Fatalf("status %d, body %q", rw.Code, rw.Body.String())
+			}
+			if next.req.URL.RawQuery != test.query {
+				t.Errorf("query %q, want %q", next.req.URL.RawQuery, test.query)
+			}
+			uri := "/insecure/ar:1/f:png/plain/https://images.example.com/docs/diagram.svg"
+			if len(test.query) > 0 {
+				uri += "?" + test.query
+			}
+			if next.req.RequestURI != uri {
+				t.Errorf("RequestURI %q, want %q", next.req.RequestURI, uri)
+			}
+		})
+	}
+}
+
+func TestDebugEndpoint(t *testing.T) {
+	jobs := [][]string{{"f", "recipes/soup.jpg"}, {"p", "trim", "4"}, {"p", "thumb", "320x240>"}}
+	handler, next := newTestHandler(t, func(config *Config) { config.DebugEndpoint = "/_debug" })
+
+	rw := serve(handler, "/_debug"+signedURL(t, testSecret, jobs, ".jpg")+"&format=webp", nil)
+	if rw.Code != http.StatusOK || next.called {
+		t.Fatalf("status %d, next called %v", rw.Code, next.called)
+	}
+	if contentType := rw.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Content-Type %q, want application/json", contentType)
+	}
+	var body debugResponse
+	if err := json.NewDecoder(rw.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if want := "/insecure/trim:4/rs:fit:320:240:0/ar:1/f:webp/plain/https://images.example.com/recipes/soup.jpg"; body.URL != want {
+		t.Errorf("url %s, want %s", body.URL, want)
+	}
+	if !reflect.DeepEqual(body.Jobs, jobs) {
+		t.Errorf("jobs %q, want %q", body.Jobs, jobs)
+	}
+
+	testServe(t, func(config *Config) { config.DebugEndpoint = "/_debug" }, []serveTest{
+		{"debug sha still checked", withSHA("/_debug"+signedURL(t, testSecret, jobs, ".jpg"), "0123456789abcdef"), nil, http.StatusForbidden, ""},
+		{"media urls forwarded", signedURL(t, testSecret, jobs, ".jpg"), nil, http.StatusOK, "/insecure/trim:4/rs:fit:320:240:0/ar:1/plain/https://images.example.com/recipes/soup.jpg"},
+	})
+}
+
+func TestCrop(t *testing.T) {
+	shot := []string{"f", "screens/dashboard.png"}
+	testURLs(t, nil, []urlTest{
+		{"crop only", [][]string{shot, {"p", "crop", "100x80+10+20"}}, "/insecure/c:100:80:nowe:10:20/ar:1/plain/https://images.example.com/screens/dashboard.png", false},
+		{"centered", [][]string{shot, {"p", "crop", "640x360"}}, "/insecure/c:640:360/ar:1/plain/https://images.example.com/screens/dashboard.png", false},
+		{"resize then crop", [][]string{shot, {"p", "thumb", "1280x"}, {"p", "crop", "640x360+0+120"}}, "/insecure/rs:fit:1280:0/c:640:360:nowe:0:120/ar:1/plain/https://images.example.com/screens/dashboard.png", false},
+		{"crop then resize", [][]string{shot, {"p", "crop", "640x360+0+120"}, {"p", "thumb", "320x"}}, "/insecure/c:640:360:nowe:0:120/rs:fit:320:0/ar:1/plain/https://images.example.com/screens/dashboard.png", false},
+		{"one offset", [][]string{shot, {"p", "crop", "100x80+10"}}, "", true},
+		{"negative offset", [][]string{shot, {"p", "crop", "100x80-10+20"}}, "", true},
+		{"no height", [][]string{shot, {"p", "crop", "100x"}}, "", true},
+		{"no geometry", [][]string{shot, {"p", "crop"}}, "", true},
+	})
+	jobs := [][]string{shot, {"p", "crop", "100x80+10+20"}}
+	testServe(t, nil, []serveTest{
+		{"offsets are signed", withSHA(signedURL(t, testSecret, jobs, ".png"), CalculateSHA(testSecret, [][]string{shot, {"p", "crop", "100x80+10+21"}})), nil, http.StatusForbidden, ""},
+	})
+}
+
+func TestAllowEnlarge(t *testing.T) {
+	icon := []string{"f", "apps/icon-32.png"}
+	testURLs(t, nil, []urlTest{
+		{"default fit unchanged", [][]string{icon, {"p", "thumb", "512x512"}}, "/insecure/rs:fit:512:512/ar:1/plain/https://images.example.com/apps/icon-32.png", false},
+		{"enlarge operator", [][]string{icon, {"p", "thumb", "512x512<"}}, "/insecure/rs:fit:512:512:1/ar:1/plain/https://images.example.com/apps/icon-32.png", false},
+		{"shrink operator", [][]string{icon, {"p", "thumb", "512x512>"}}, "/insecure/rs:fit:512:512:0/ar:1/plain/https://images.example.com/apps/icon-32.png", false},
+	})
+	testURLs(t, func(config *Config) { config.AllowEnlarge = false }, []urlTest{
+		{"default fit", [][]string{icon, {"p", "thumb", "512x512"}}, "/insecure/rs:fit:512:512:0/ar:1/plain/https://images.example.com/apps/icon-32.png", false},
+		{"width only", [][]string{icon, {"p", "thumb", "512x"}}, "/insecure/rs:fit:512:0:0/ar:1/plain/https://images.example.com/apps/icon-32.png", false},
+		{"enlarge operator still enlarges", [][]string{icon, {"p", "thumb", "512x512<"}}, "/insecure/rs:fit:512:512:1/ar:1/plain/https://images.example.com/apps/icon-32.png", false},
+		{"fill untouched", [][]string{icon, {"p", "thumb", "512x512#"}}, "/insecure/rs:fill:512:512:g:ce/ar:1/plain/https://images.example.com/apps/icon-32.png", false},
+	})
+}
+
+func TestEmptyJobs(t *testing.T) {
+	encode := func(payload string) string {
+		return "/media/" + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".jpg"
+	}
+	testServe(t, nil, []serveTest{
+		{"empty list", encode(`[]`) + "?sha=" + CalculateSHA(testSecret, [][]string{}), nil, http.StatusBadRequest, ""},
+		{"empty job", encode(`[[]]`) + "?sha=" + CalculateSHA(testSecret, [][]string{{}}), nil, http.StatusBadRequest, ""},
+		{"type only", encode(`[["f"]]`) + "?sha=" + CalculateSHA(testSecret, [][]string{{"f"}}), nil, http.StatusBadRequest, ""},
+		{"empty job after fetch", encode(`[["f","a.jpg"],[]]`) + "?sha=0123456789abcdef", nil, http.StatusBadRequest, ""},
+	})
+	if sha := CalculateSHA(testSecret, [][]string{{}, {"f", "a.jpg"}}); sha != CalculateSHA(testSecret, [][]string{{"f", "a.jpg"}}) {
+		t.Errorf("an empty job changed the signature: %s", sha)
+	}
+}
+
+func TestAbsoluteSource(t *testing.T) {
+	testURLs(t, nil, []urlTest{
+		{"https", [][]string{{"f", "https://other.cdn/x.jpg"}}, "/insecure/ar:1/plain/https:%2F%2Fother.cdn%2Fx.jpg", false},
+		{"upper case scheme", [][]string{{"f", "HTTP://Legacy.Host/Banner.PNG"}, {"p", "thumb", "320x"}}, "/insecure/rs:fit:320:0/ar:1/plain/HTTP:%2F%2FLegacy.Host%2FBanner.PNG", false},
+		{"query string", [][]string{{"f", "https://cdn.partner.io/render?id=77&w=2"}}, "/insecure/ar:1/plain/https:%2F%2Fcdn.partner.io%2Frender%3Fid=77&w=2", false},
+		{"at sign", [][]string{{"f", "https://assets.shop/icons/cart@2x.png"}, {"p", "thumb", "48x48#"}}, "/insecure/rs:fill:48:48:g:ce/ar:1/plain/https:%2F%2Fassets.shop%2Ficons%2Fcart%402x.png", false},
+		{"data uri", [][]string{{"f", "data:image/gif;base64,R0lGOD"}}, "/insecure/ar:1/plain/data:image%2Fgif%3Bbase64%2CR0lGOD", false},
+		{"relative", [][]string{{"f", "http-docs/spec.png"}}, "/insecure/ar:1/plain/https://images.example.com/http-docs/spec.png", false},
+	})
+	testURLs(t, func(config *Config) { config.SourceURLMode = "base64" }, []urlTest{
+		{"base64 keeps url raw", [][]string{{"f", "https://cdn.partner.io/a b@1x.webp?sig=z"}}, "/insecure/ar:1/" + base64.RawURLEncoding.EncodeToString([]byte("https://cdn.partner.io/a b@1x.webp?sig=z")), false},
+	})
+
+	jobs := [][]string{{"f", "https://mirror.example.net/covers/vol%201@hi.jpg?rev=3"}, {"p", "thumb", "250x250>"}}
+	testServe(t, nil, []serveTest{
+		{"forwarded escaped once", signedURL(t, testSecret, jobs, ".jpg"), nil, http.StatusOK, "/insecure/rs:fit:250:250:0/ar:1/plain/https:%2F%2Fmirror.example.net%2Fcovers%2Fvol%25201%40hi.jpg%3Frev=3"},
+	})
+}
+
+// next handler blocking until its request context is done
+type blockingHandler struct {
+	deadline bool
+	err      error
+}
+
+func (b *blockingHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	_, b.deadline = req.Context().Deadline()
+	select {
+	case <-req.Context().Done():
+		b.err = req.Context().Err()
+	case <-time.After(2 * time.Second):
+	}
+	rw.WriteHeader(http.StatusGatewayTimeout)
+}
+
+func TestProcessTimeout(t *testing.T) {
+	target := signedURL(t, testSecret, [][]string{{"f", "uploads/slow/render.png"}, {"p", "thumb", "64x64#"}}, ".png")
+	newBlocking := func(timeout string) (http.Handler, *blockingHandler) {
+		config := testConfig()
+		config.ProcessTimeout = timeout
+		next := &blockingHandler{}
+		handler, err := New(context.Background(), next, config, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return handler, next
+	}
+
+	handler, next := newBlocking("15ms")
+	start := time.Now()
+	serve(handler, target, nil)
+	if next.err != context.DeadlineExceeded {
+		t.Errorf("context error %v, want %v", next.err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("next returned after %s", elapsed)
+	}
+
+	// a cancelled client request still reaches next without a timeout set
+	handler, next = newBlocking("")
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodGet, target, nil).WithContext(ctx)
+	cancel()
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if next.deadline || next.err != context.Canceled {
+		t.Errorf("deadline %v, context error %v, want no deadline and %v", next.deadline, next.err, context.Canceled)
+	}
+
+	for _, timeout := range []string{"fast", "-3s", "90"} {
+		config := testConfig()
+		config.ProcessTimeout = timeout
+		if _, err := New(context.Background(), &nextHandler{}, config, "test"); err == nil {
+			t.Errorf("ProcessTimeout %q accepted", timeout)
+		}
+	}
+}
+
+func TestFormatQuality(t *testing.T) {
+	jobs := [][]string{{"f", "catalog/sofa-grey.jpg"}, {"p", "thumb", "800x600>"}}
+	for _, test := range []struct {
+		jpeg, webp int
+		want       string
+	}{
+		{0, 0, "/insecure/rs:fit:800:600:0/ar:1/plain/https://images.example.com/catalog/sofa-grey.jpg"},
+		{72, 0, "/insecure/rs:fit:800:600:0/fq:jpg:72/ar:1/plain/https://images.example.com/catalog/sofa-grey.jpg"},
+		{0, 64, "/insecure/rs:fit:800:600:0/fq:webp:64/ar:1/plain/https://images.example.com/catalog/sofa-grey.jpg"},
+		{90, 100, "/insecure/rs:fit:800:600:0/fq:jpg:90:webp:100/ar:1/plain/https://images.example.com/catalog/sofa-grey.jpg"},
+	} {
+		jpeg, webp := test.jpeg, test.webp
+		testURLs(t, func(config *Config) { config.JpegQuality, config.WebpQuality = jpeg, webp }, []urlTest{
+			{"jpg " + strconv.Itoa(jpeg) + " webp " + strconv.Itoa(webp), jobs, test.want, false},
+		})
+	}
+
+	for _, invalid := range [][2]int{{101, 0}, {0, -5}, {-1, 50}} {
+		config := testConfig()
+		config.JpegQuality, config.WebpQuality = invalid[0], invalid[1]
+		_, err := New(context.Background(), &nextHandler{}, config, "test")
+		if err == nil || !strings.Contains(err.Error(), "between 0 and 100") {
+			t.Errorf("quality %v: error %v, want the 0 to 100 range", invalid, err)
+		}
+	}
+}
+
+func TestAllowedPathPrefixes(t *testing.T) {
+	allow := func(config *Config) { config.AllowedPathPrefixes = []string{"public/", "shared/avatars/"} }
+	served := func(source string) string {
+		return signedURL(t, testSecret, [][]string{{"f", source}, {"p", "thumb", "120x120#"}}, ".jpg")
+	}
+	testServe(t, allow, []serveTest{
+		{"allowed public/x.jpg", served("public/x.jpg"), nil, http.StatusOK, "/insecure/rs:fill:120:120:g:ce/ar:1/plain/https://images.example.com/public/x.jpg"},
+		{"second prefix", served("shared/avatars/u17.jpg"), nil, http.StatusOK, "/insecure/rs:fill:120:120:g:ce/ar:1/plain/https://images.example.com/shared/avatars/u17.jpg"},
+		{"rejected private/x.jpg", served("private/x.jpg"), nil, http.StatusForbidden, ""},
+		{"sibling of an allowed prefix", served("shared/invoices/q3.jpg"), nil, http.StatusForbidden, ""},
+		{"dot dot out of the prefix", served("public/../private/x.jpg"), nil, http.StatusForbidden, ""},
+		{"absolute url", served("https://elsewhere.example.org/public/x.jpg"), nil, http.StatusForbidden, ""},
+	})
+	testServe(t, nil, []serveTest{
+		{"no allowlist", served("private/x.jpg"), nil, http.StatusOK, "/insecure/rs:fill:120:120:g:ce/ar:1/plain/https://images.example.com/private/x.jpg"},
+	})
+}
+
+func TestStripMetadata(t *testing.T) {
+	if !CreateConfig().StripMetadata {
+		t.Error("StripMetadata is off by default")
+	}
+	jobs := [][]string{{"f", "staff/portraits/lee.heic"}, {"p", "thumb", "300x300#"}}
+	testURLs(t, func(config *Config) { config.StripMetadata = true }, []urlTest{
+		{"enabled", jobs, "/insecure/rs:fill:300:300:g:ce/sm:1/ar:1/plain/https://images.example.com/staff/portraits/lee.heic", false},
+	})
+	testURLs(t, func(config *Config) { config.StripMetadata = false }, []urlTest{
+		{"disabled", jobs, "/insecure/rs:fill:300:300:g:ce/ar:1/plain/https://images.example.com/staff/portraits/lee.heic", false},
+	})
+}
+
+func TestAutoRotate(t *testing.T) {
+	if !CreateConfig().AutoRotate {
+		t.Error("AutoRotate is off by default")
+	}
+	scan := []string{"f", "field-notes/page-03.jpg"}
+	testURLs(t, func(config *Config) { config.AutoRotate = true }, []urlTest{
+		{"on", [][]string{scan, {"p", "thumb", "700x"}}, "/insecure/rs:fit:700:0/ar:1/plain/https://images.example.com/field-notes/page-03.jpg", false},
+		{"on with rotate", [][]string{scan, {"p", "rotate", "90"}, {"p", "thumb", "700x"}}, "/insecure/rot:90/rs:fit:700:0/ar:1/plain/https://images.example.com/field-notes/page-03.jpg", false},
+	})
+	testURLs(t, func(config *Config) { config.AutoRotate = false }, []urlTest{
+		{"off", [][]string{scan, {"p", "thumb", "700x"}}, "/insecure/rs:fit:700:0/ar:0/plain/https://images.example.com/field-notes/page-03.jpg", false},
+		{"off with counter clockwise rotate", [][]string{scan, {"p", "rotate", "-90"}}, "/insecure/rot:270/ar:0/plain/https://images.example.com/field-notes/page-03.jpg", false},
+		{"full turn", [][]string{scan, {"p", "rotate", "540"}}, "/insecure/rot:180/ar:0/plain/https://images.example.com/field-notes/page-03.jpg", false},
+		{"not a right angle", [][]string{scan, {"p", "rotate", "45"}}, "", true},
+		{"named angle", [][]string{scan, {"p", "rotate", "left"}}, "", true},
+		{"missing angle", [][]string{scan, {"p", "rotate"}}, "", true},
+	})
+}
+
+func TestMaxDimensions(t *testing.T) {
+	banner := []string{"f", "campaigns/spring/hero.png"}
+	thumb := func(geometry string) [][]string { return [][]string{banner, {"p", "thumb", geometry}} }
+	limits := func(config *Config) { config.MaxWidth, config.MaxHeight = 1920, 1080 }
+	testURLs(t, limits, []urlTest{
+		{"at the limits", thumb("1920x1080#"), "/insecure/rs:fill:1920:1080:g:ce/ar:1/plain/https://images.example.com/campaigns/spring/hero.png", false},
+		{"width only", thumb("1280x"), "/insecure/rs:fit:1280:0/ar:1/plain/https://images.example.com/campaigns/spring/hero.png", false},
+		{"width over", thumb("1921x400>"), "", true},
+		{"height over", thumb("640x1081"), "", true},
+		{"both over", thumb("8000x8000^"), "", true},
+	})
+	testURLs(t, func(config *Config) { config.MaxHeight = 500 }, []urlTest{
+		{"only height limited", thumb("4000x500"), "/insecure/rs:fit:4000:500/ar:1/plain/https://images.example.com/campaigns/spring/hero.png", false},
+	})
+
+	testServe(t, limits, []serveTest{
+		{"rejected with 400", signedURL(t, testSecret, thumb("1920x2000#"), ".png"), nil, http.StatusBadRequest, ""},
+	})
+	for _, invalid := range [][2]int{{-1, 0}, {0, -720}} {
+		config := testConfig()
+		config.MaxWidth, config.MaxHeight = invalid[0], invalid[1]
+		if _, err := New(context.Background(), &nextHandler{}, config, "test"); err == nil {
+			t.Errorf("New accepted MaxWidth %d MaxHeight %d", invalid[0], invalid[1])
+		}
+	}
+}
+
+func TestForceGeometry(t *testing.T) {
+	card := []string{"f", "members/cards/0042.png"}
+	forced := [][]string{card, {"p", "thumb", "400x300!"}}
+	testURLs(t, func(config *Config) { config.Gravity = "noea" }, []urlTest{
+		{"force ignores gravity", forced, "/insecure/rs:force:400:300/ar:1/plain/https://images.example.com/members/cards/0042.png", false},
+		{"fill geometry takes gravity", [][]string{card, {"p", "thumb", "400x300#"}}, "/insecure/rs:fill:400:300:g:noea/ar:1/plain/https://images.example.com/members/cards/0042.png", false},
+	})
+	testURLs(t, func(config *Config) { config.ForceGeometryAsFill = true }, []urlTest{
+		{"fill with default gravity", forced, "/insecure/rs:fill:400:300/g:ce/ar:1/plain/https://images.example.com/members/cards/0042.png", false},
+	})
+	testURLs(t, func(config *Config) { config.ForceGeometryAsFill, config.Gravity = true, "sowe" }, []urlTest{
+		{"fill with configured gravity", forced, "/insecure/rs:fill:400:300/g:sowe/ar:1/plain/https://images.example.com/members/cards/0042.png", false},
+	})
+
+	boxed := signedURL(t, testSecret, [][]string{card, {"p", "thumb", "250x250>"}}, ".png") + "&extend=true"
+	testServe(t, func(config *Config) { config.Gravity = "so" }, []serveTest{
+		{"extend with gravity", boxed, nil, http.StatusOK, "/insecure/rs:fit:250:250:0/ar:1/ex:1:so/plain/https://images.example.com/members/cards/0042.png"},
+	})
+	testServe(t, func(config *Config) { config.Gravity = "sm" }, []serveTest{
+		{"extend centers smart gravity", boxed, nil, http.StatusOK, "/insecure/rs:fit:250:250:0/ar:1/ex:1:ce/plain/https://images.example.com/members/cards/0042.png"},
+	})
+
+	for gravity, valid := range map[string]bool{"": true, "sm": true, "nowe": true, "center": false, "NO": false} {
+		config := testConfig()
+		config.Gravity = gravity
+		if _, err := New(context.Background(), &nextHandler{}, config, "test"); (err == nil) != valid {
+			t.Errorf("Gravity %q: error %v", gravity, err)
+		}
+	}
+}
+
+func TestSkipPaths(t *testing.T) {
+	skip := func(config *Config) { config.SkipPaths = []string{"/healthz", "/status/"} }
+	testServe(t, skip, []serveTest{
+		{"health check forwarded", "/healthz", nil, http.StatusOK, "/healthz"},
+		{"below a skip path", "/status/ready", nil, http.StatusOK, "/status/ready"},
+		{"skip path without its slash", "/status", nil, http.StatusOK, "/status"},
+		{"longer name not skipped", "/healthzcheck", nil, http.StatusBadRequest, ""},
+		{"media still processed", signedURL(t, testSecret, [][]string{{"f", "docs/diagram.svg"}, {"p", "thumb", "90x"}}, ".svg"), nil, http.StatusOK, "/insecure/rs:fit:90:0/ar:1/plain/https://images.example.com/docs/diagram.svg"},
+	})
+	testServe(t, nil, []serveTest{
+		{"not skipped by default", "/healthz", nil, http.StatusBadRequest, ""},
+	})
+}
+
+func TestPassthroughUnmatched(t *testing.T) {
+	icon := signedURL(t, testSecret, [][]string{{"f", "ui/icons/bell.png"}, {"p", "thumb", "32x32#"}}, ".png")
+	testServe(t, func(config *Config) { config.PassthroughUnmatched = true }, []serveTest{
+		{"unmatched forwarded", "/static/js/app.min.js", nil, http.StatusOK, "/static/js/app.min.js"},
+		{"other prefix forwarded", "/uploads/2024/report.pdf", nil, http.StatusOK, "/uploads/2024/report.pdf"},
+		{"matched rewritten", icon, nil, http.StatusOK, "/insecure/rs:fill:32:32:g:ce/ar:1/plain/https://images.example.com/ui/icons/bell.png"},
+		{"matched with bad sha rejected", withSHA(icon, "feedfacefeedface"), nil, http.StatusForbidden, ""},
+	})
+	testServe(t, func(config *Config) { config.PassthroughUnmatched = false }, []serveTest{
+		{"unmatched fails", "/static/js/app.min.js", nil, http.StatusBadRequest, ""},
+		{"matched rewritten", icon, nil, http.StatusOK, "/insecure/rs:fill:32:32:g:ce/ar:1/plain/https://images.example.com/ui/icons/bell.png"},
+	})
+
+	handler, next := newTestHandler(t, func(config *Config) {
+		config.PassthroughUnmatched = true
+		config.EnableMetrics = true
+	})
+	serve(handler, "/favicon.ico?v=3", nil)
+	if next.req.URL.RawQuery != "v=3" {
+		t.Errorf("query rewritten to %q", next.req.URL.RawQuery)
+	}
+	if got := handler.(*Dragonfly2imgproxy).Collector(); got.Requests != 0 {
+		t.Errorf("forwarded request counted, requests %d", got.Requests)
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	preview := signedURL(t, testSecret, [][]string{{"f", "listings/77/floorplan.jpg"}, {"p", "thumb", "1024x768>"}}, ".jpg")
+	testServe(t, nil, []serveTest{
+		{"maxbytes=100000", preview + "&maxbytes=100000", nil, http.StatusOK, "/insecure/rs:fit:1024:768:0/ar:1/mb:100000/plain/https://images.example.com/listings/77/floorplan.jpg"},
+		{"before a forced format", preview + "&maxbytes=2048&format=webp", nil, http.StatusOK, "/insecure/rs:fit:1024:768:0/ar:1/mb:2048/f:webp/plain/https://images.example.com/listings/77/floorplan.jpg"},
+		{"absent", preview, nil, http.StatusOK, "/insecure/rs:fit:1024:768:0/ar:1/plain/https://images.example.com/listings/77/floorplan.jpg"},
+		{"maxbytes=abc", preview + "&maxbytes=abc", nil, http.StatusBadRequest, ""},
+		{"zero", preview + "&maxbytes=0", nil, http.StatusBadRequest, ""},
+		{"negative", preview + "&maxbytes=-500", nil, http.StatusBadRequest, ""},
+	})
+
+	handler, next := newTestHandler(t, func(config *Config) { config.PassthroughParams = []string{"maxbytes", "lang"} })
+	serve(handler, preview+"&maxbytes=4096&lang=de", nil)
+	if next.req.URL.RawQuery != "lang=de" {
+		t.Errorf("query %q, maxbytes must not be passed through", next.req.URL.RawQuery)
+	}
+}
+
+func TestZoom(t *testing.T) {
+	tile := []string{"f", "maps/tiles/12/655/1583.png"}
+	testURLs(t, nil, []urlTest{
+		{"uniform", [][]string{tile, {"p", "zoom", "1.5"}}, "/insecure/zoom:1.5/ar:1/plain/https://images.example.com/maps/tiles/12/655/1583.png", false},
+		{"independent", [][]string{tile, {"p", "zoom", "1.5", "2.0"}}, "/insecure/zoom:1.5:2/ar:1/plain/https://images.example.com/maps/tiles/12/655/1583.png", false},
+		{"factors normalized", [][]string{tile, {"p", "zoom", "0.250", "5e-1"}}, "/insecure/zoom:0.25:0.5/ar:1/plain/https://images.example.com/maps/tiles/12/655/1583.png", false},
+		{"at the cap", [][]string{tile, {"p", "zoom", "10"}}, "/insecure/zoom:10/ar:1/plain/https://images.example.com/maps/tiles/12/655/1583.png", false},
+		{"over the cap", [][]string{tile, {"p", "zoom", "10.5"}}, "", true},
+		{"zero", [][]string{tile, {"p", "zoom", "0"}}, "", true},
+		{"negative y", [][]string{tile, {"p", "zoom", "1", "-2"}}, "", true},
+		{"not a number", [][]string{tile, {"p", "zoom", "NaN"}}, "", true},
+		{"infinite", [][]string{tile, {"p", "zoom", "+Inf"}}, "", true},
+		{"no factor", [][]string{tile, {"p", "zoom"}}, "", true},
+		{"three factors", [][]string{tile, {"p", "zoom", "1", "1", "1"}}, "", true},
+	})
+
+	limits := func(config *Config) { config.MaxWidth, config.MaxHeight = 1200, 900 }
+	testURLs(t, limits, []urlTest{
+		{"zoomed within the limits", [][]string{tile, {"p", "thumb", "600x450#"}, {"p", "zoom", "2"}}, "/insecure/rs:fill:600:450:g:ce/zoom:2/ar:1/plain/https://images.example.com/maps/tiles/12/655/1583.png", false},
+		{"zoom before the resize", [][]string{tile, {"p", "zoom", "2.5"}, {"p", "thumb", "400x300"}}, "/insecure/zoom:2.5/rs:fit:400:300/ar:1/plain/https://images.example.com/maps/tiles/12/655/1583.png", false},
+		{"zoomed width over", [][]string{tile, {"p", "thumb", "700x300"}, {"p", "zoom", "2"}}, "", true},
+		{"zoomed height over", [][]string{tile, {"p", "thumb", "400x500"}, {"p", "zoom", "1", "2"}}, "", true},
+		{"height unknown", [][]string{tile, {"p", "thumb", "400x"}, {"p", "zoom", "1.1"}}, "", true},
+		{"no resize", [][]string{tile, {"p", "zoom", "1.2"}}, "", true},
+		{"zoom out without resize", [][]string{tile, {"p", "zoom", "0.5"}}, "/insecure/zoom:0.5/ar:1/plain/https://images.example.com/maps/tiles/12/655/1583.png", false},
+	})
+	testURLs(t, func(config *Config) { config.MaxHeight = 900 }, []urlTest{
+		{"only height limited", [][]string{tile, {"p", "thumb", "3000x300"}, {"p", "zoom", "3"}}, "/insecure/rs:fit:3000:300/zoom:3/ar:1/plain/https://images.example.com/maps/tiles/12/655/1583.png", false},
+	})
+
+	// the factors are signed with the job
+	zoomed := signedURL(t, testSecret, [][]string{tile, {"p", "zoom", "1.5"}}, ".png")
+	testServe(t, nil, []serveTest{
+		{"signed factors", zoomed, nil, http.StatusOK, "/insecure/zoom:1.5/ar:1/plain/https://images.example.com/maps/tiles/12/655/1583.png"},
+		{"factor changed", withSHA(signedURL(t, testSecret, [][]string{tile, {"p", "zoom", "3"}}, ".png"), CalculateSHA(testSecret, [][]string{tile, {"p", "zoom", "1.5"}})), nil, http.StatusForbidden, ""},
+	})
+}
+
+func TestWatermark(t *testing.T) {
+	still := []string{"f", "press/stills/ep04-012.jpg"}
+	mark := func(args ...string) [][]string { return [][]string{still, append([]string{"p", "watermark"}, args...)} }
+	testURLs(t, nil, []urlTest{
+		{"basic", mark("0.5", "ce", "0", "0"), "/insecure/wm:0.5:ce:0:0/ar:1/plain/https://images.example.com/press/stills/ep04-012.jpg", false},
+		{"opacity only", mark("1"), "/insecure/wm:1/ar:1/plain/https://images.example.com/press/stills/ep04-012.jpg", false},
+		{"corner with negative offsets", mark(".35", "soea", "-12", "-8.5"), "/insecure/wm:0.35:soea:-12:-8.5/ar:1/plain/https://images.example.com/press/stills/ep04-012.jpg", false},
+		{"replicated", mark("0.1", "re"), "/insecure/wm:0.1:re/ar:1/plain/https://images.example.com/press/stills/ep04-012.jpg", false},
+		{"opacity above 1", mark("1.2", "ce"), "", true},
+		{"negative opacity", mark("-0.5"), "", true},
+		{"opacity NaN", mark("NaN"), "", true},
+		{"smart position", mark("0.5", "sm"), "", true},
+		{"unknown position", mark("0.5", "middle"), "", true},
+		{"offset not a number", mark("0.5", "no", "ten", "0"), "", true},
+		{"infinite offset", mark("0.5", "no", "0", "Inf"), "", true},
+		{"too many arguments", mark("0.5", "ce", "0", "0", "2"), "", true},
+		{"no opacity", mark(), "", true},
+	})
+
+	// the arguments are signed with the job
+	signed := signedURL(t, testSecret, mark("0.5", "nowe"), ".jpg")
+	moved := withSHA(signedURL(t, testSecret, mark("0.5", "soea"), ".jpg"), CalculateSHA(testSecret, mark("0.5", "nowe")))
+	testServe(t, nil, []serveTest{
+		{"signed", signed, nil, http.StatusOK, "/insecure/wm:0.5:nowe/ar:1/plain/https://images.example.com/press/stills/ep04-012.jpg"},
+		{"position changed", moved, nil, http.StatusForbidden, ""},
+	})
+}
+
+func TestWatermarkURL(t *testing.T) {
+	frame := []string{"f", "press/stills/ep05-101.jpg"}
+	const logo = "https://cdn.example.com/brand/logo-white.png?v=3"
+	jobs := [][]string{frame, {"p", "thumb", "1280x"}, {"p", "watermark_url", logo, "0.5", "so"}}
+
+	got, err := generate_imgproxy_url(testConfig(), jobs, requestOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	match := regexp.MustCompile(`/wmu:([A-Za-z0-9_-]+)/wm:0\.5:so/`).FindStringSubmatch(got)
+	if match == nil {
+		t.Fatalf("no wmu and wm options in %s", got)
+	}
+	if decoded, err := base64.RawURLEncoding.DecodeString(match[1]); err != nil || string(decoded) != logo {
+		t.Errorf("wmu decodes to %q (%v), want %q", decoded, err, logo)
+	}
+	if strings.Contains(got, "cdn.example.com") {
+		t.Errorf("watermark url not encoded: %s", got)
+	}
+
+	for _, args := range [][]string{
+		{"ftp://cdn.example.com/logo.png", "0.5"},
+		{"/brand/logo.png", "0.5"},
+		{logo},
+		{logo, "2"},
+		{logo, "0.5", "sm"},
+	} {
+		if _, err := generate_imgproxy_url(testConfig(), [][]string{frame, append([]string{"p", "watermark_url"}, args...)}, requestOptions{}); err == nil {
+			t.Errorf("watermark_url %q accepted", args)
+		}
+	}
+
+	// the url, opacity and position are all signed
+	handler, _ := newTestHandler(t, nil)
+	if rec := serve(handler, signedURL(t, testSecret, jobs, ".jpg"), nil); rec.Code != http.StatusOK {
+		t.Errorf("signed watermark url: status %d", rec.Code)
+	}
+	for _, changed := range [][]string{
+		{"p", "watermark_url", "https://evil.example.com/logo.png", "0.5", "so"},
+		{"p", "watermark_url", logo, "0.9", "so"},
+		{"p", "watermark_url", logo, "0.5", "no"},
+	} {
+		forged := withSHA(signedURL(t, testSecret, [][]string{frame, jobs[1], changed}, ".jpg"), CalculateSHA(testSecret, jobs))
+		if rec := serve(handler, forged, nil); rec.Code != http.StatusForbidden {
+			t.Errorf("%q with the original sha: status %d", changed, rec.Code)
+		}
+	}
+}
+
+func TestPad(t *testing.T) {
+	logo := []string{"f", "brands/acme/logo.png"}
+	boxed := func(values ...string) [][]string {
+		return [][]string{logo, {"p", "thumb", "180x60>"}, append([]string{"p", "pad"}, values...)}
+	}
+	testURLs(t, nil, []urlTest{
+		{"uniform", boxed("10"), "/insecure/rs:fit:180:60:0/pd:10/ar:1/plain/https://images.example.com/brands/acme/logo.png", false},
+		{"four values", boxed("10", "20", "10", "20"), "/insecure/rs:fit:180:60:0/pd:10:20:10:20/ar:1/plain/https://images.example.com/brands/acme/logo.png", false},
+		{"vertical and horizontal", boxed("0", "16"), "/insecure/rs:fit:180:60:0/pd:0:16/ar:1/plain/https://images.example.com/brands/acme/logo.png", false},
+		{"leading zeros", boxed("008"), "/insecure/rs:fit:180:60:0/pd:8/ar:1/plain/https://images.example.com/brands/acme/logo.png", false},
+		{"negative", boxed("4", "-4"), "", true},
+		{"fractional", boxed("2.5"), "", true},
+		{"unit", boxed("12px"), "", true},
+		{"five values", boxed("1", "2", "3", "4", "5"), "", true},
+		{"no value", boxed(), "", true},
+	})
+
+	// the padding is signed with the job
+	testServe(t, nil, []serveTest{
+		{"signed", signedURL(t, testSecret, boxed("6"), ".png"), nil, http.StatusOK, "/insecure/rs:fit:180:60:0/pd:6/ar:1/plain/https://images.example.com/brands/acme/logo.png"},
+		{"padding changed", withSHA(signedURL(t, testSecret, boxed("60"), ".png"), CalculateSHA(testSecret, boxed("6"))), nil, http.StatusForbidden, ""},
+	})
+}
+
+// imgproxy resize option fields, rs:%resizing_type:%width:%height:%enlarge:%extend
+type imgproxyResize struct {
+	resizingType, width, height, enlarge, extend string
+}
+
+// Parse the rs option of an imgproxy path, fields missing from it stay empty
+func parseResize(t *testing.T, imgproxy_url string) imgproxyResize {
+	t.Helper()
+	for _, option := range strings.Split(imgproxy_url, "/") {
+		if !strings.HasPrefix(option, "rs:") {
+			continue
+		}
+		fields := append(strings.Split(option, ":")[1:], "", "", "", "", "")
+		return imgproxyResize{fields[0], fields[1], fields[2], fields[3], fields[4]}
+	}
+	t.Fatalf("no rs option in %s", imgproxy_url)
+	return imgproxyResize{}
+}
+
+func TestShrinkOnlyGeometry(t *testing.T) {
+	avatar := []string{"f", "people/ines/avatar.webp"}
+	for _, test := range []struct {
+		geometry string
+		want     imgproxyResize
+		url      string
+	}{
+		// shrink only: fit, enlarge 0, imgproxy keeps smaller images as they are
+		{"50x50>", imgproxyResize{"fit", "50", "50", "0", ""}, "/insecure/rs:fit:50:50:0/ar:1/plain/https://images.example.com/people/ines/avatar.webp"},
+		{"50x>", imgproxyResize{"fit", "50", "0", "0", ""}, "/insecure/rs:fit:50:0:0/ar:1/plain/https://images.example.com/people/ines/avatar.webp"},
+		// enlarge smaller images: fit, enlarge 1
+		{"50x50<", imgproxyResize{"fit", "50", "50", "1", ""}, "/insecure/rs:fit:50:50:1/ar:1/plain/https://images.example.com/people/ines/avatar.webp"},
+	} {
+		for _, gravity := range []string{"ce", "sowe", "sm"} { // fit resizes take no gravity
+			config := testConfig()
+			config.Gravity = gravity
+			got, err := generate_imgproxy_url(config, [][]string{avatar, {"p", "thumb", test.geometry}}, requestOptions{})
+			if err != nil {
+				t.Fatalf("%s: %v", test.geometry, err)
+			}
+			if got != test.url {
+				t.Errorf("%s with gravity %s: got %s, want %s", test.geometry, gravity, got, test.url)
+			}
+			if resize := parseResize(t, got); resize != test.want {
+				t.Errorf("%s: resize %+v, want %+v", test.geometry, resize, test.want)
+			}
+		}
+	}
+}
+
+func TestEmptyDimensions(t *testing.T) {
+	poster := []string{"f", "films/1987/poster.jpg"}
+	thumb := func(geometry string) [][]string { return [][]string{poster, {"p", "thumb", geometry}} }
+	testURLs(t, nil, []urlTest{
+		{"400x", thumb("400x"), "/insecure/rs:fit:400:0/ar:1/plain/https://images.example.com/films/1987/poster.jpg", false},
+		{"x300", thumb("x300"), "/insecure/rs:fit:0:300/ar:1/plain/https://images.example.com/films/1987/poster.jpg", false},
+		{"400x300", thumb("400x300"), "/insecure/rs:fit:400:300/ar:1/plain/https://images.example.com/films/1987/poster.jpg", false},
+		{"x300 shrink only", thumb("x300>"), "/insecure/rs:fit:0:300:0/ar:1/plain/https://images.example.com/films/1987/poster.jpg", false},
+		{"x300 fill", thumb("x300#"), "/insecure/rs:fill:0:300:g:ce/ar:1/plain/https://images.example.com/films/1987/poster.jpg", false},
+		{"x", thumb("x"), "", true},
+		{"x with operator", thumb("x<"), "", true},
+		{"no separator", thumb("400"), "", true},
+	})
+	testURLs(t, func(config *Config) { config.CaretAsMinDimensions = true }, []urlTest{
+		{"min height only", thumb("x300^"), "/insecure/mh:300/ar:1/plain/https://images.example.com/films/1987/poster.jpg", false},
+	})
+
+	for _, geometry := range []string{"400x", "x300", "400x300", "x300>"} {
+		got, err := generate_imgproxy_url(testConfig(), thumb(geometry), requestOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resize := parseResize(t, got); resize.width == "" || resize.height == "" {
+			t.Errorf("%s: empty dimension in %s", geometry, got)
+		}
+	}
+}
+
+func TestMaxURLLength(t *testing.T) {
+	deep := "archive/" + strings.Repeat("nested-folder/", 40) + "scan.png"
+	short := signedURL(t, testSecret, [][]string{{"f", "archive/scan.png"}, {"p", "thumb", "200x200#"}}, ".png")
+	long := signedURL(t, testSecret, [][]string{{"f", deep}, {"p", "thumb", "200x200#"}}, ".png")
+	shortWant := "/insecure/rs:fill:200:200:g:ce/ar:1/plain/https://images.example.com/archive/scan.png"
+	testServe(t, func(config *Config) { config.MaxURLLength = 512 }, []serveTest{
+		{"short path", short, nil, http.StatusOK, shortWant},
+		{"long path", long, nil, http.StatusRequestURITooLong, ""},
+	})
+	testServe(t, func(config *Config) { config.MaxURLLength = len(shortWant) }, []serveTest{
+		{"exactly the limit", short, nil, http.StatusOK, shortWant},
+	})
+	testServe(t, func(config *Config) { config.MaxURLLength = len(shortWant) - 1 }, []serveTest{
+		{"one over the limit", short, nil, http.StatusRequestURITooLong, ""},
+	})
+	testServe(t, nil, []serveTest{
+		{"no limit", long, nil, http.StatusOK, "/insecure/rs:fill:200:200:g:ce/ar:1/plain/" + testPrefix + deep},
+	})
+
+	config := testConfig()
+	config.MaxURLLength = -2048
+	if _, err := New(context.Background(), &nextHandler{}, config, "test"); err == nil {
+		t.Error("New accepted a negative MaxURLLength")
+	}
+}
+
+func TestBase64SourceExtension(t *testing.T) {
+	encoded := func(source string) string { return base64.RawURLEncoding.EncodeToString([]byte(source)) }
+	clip := []string{"f", "loops/Confetti.GIF"}
+	still := []string{"f", "menus/brunch.jpeg"}
+	testURLs(t, func(config *Config) { config.SourceURLMode = "plain" }, []urlTest{
+		{"plain", [][]string{still, {"p", "thumb", "500x"}}, "/insecure/rs:fit:500:0/ar:1/plain/https://images.example.com/menus/brunch.jpeg", false},
+		{"plain forced gif", [][]string{clip, {"p", "thumb", "240x"}}, "/insecure/rs:fit:240:0/ar:1/f:gif/plain/https://images.example.com/loops/Confetti.GIF", false},
+	})
+	testURLs(t, func(config *Config) { config.SourceURLMode = "base64" }, []urlTest{
+		{"base64 with the source extension", [][]string{still, {"p", "thumb", "500x"}}, "/insecure/rs:fit:500:0/ar:1/" + encoded("https://images.example.com/menus/brunch.jpeg") + ".jpg", false},
+		{"forced gif as the extension", [][]string{clip, {"p", "thumb", "240x"}}, "/insecure/rs:fit:240:0/ar:1/" + encoded("https://images.example.com/loops/Confetti.GIF") + ".gif", false},
+		{"unknown extension left off", [][]string{{"f", "scans/contract.tiff"}}, "/insecure/ar:1/" + encoded("https://images.example.com/scans/contract.tiff"), false},
+		{"no extension", [][]string{{"f", "avatars/7f3e"}}, "/insecure/ar:1/" + encoded("https://images.example.com/avatars/7f3e"), false},
+	})
+
+	target := signedURL(t, testSecret, [][]string{still, {"p", "thumb", "500x"}}, ".jpeg")
+	testServe(t, func(config *Config) { config.SourceURLMode = "base64" }, []serveTest{
+		{"format parameter replaces the extension", target + "&format=webp", nil, http.StatusOK, "/insecure/rs:fit:500:0/ar:1/" + encoded("https://images.example.com/menus/brunch.jpeg") + ".webp"},
+	})
+	testServe(t, func(config *Config) { config.SourceURLMode = "plain" }, []serveTest{
+		{"format parameter as f", target + "&format=webp", nil, http.StatusOK, "/insecure/rs:fit:500:0/ar:1/f:webp/plain/https://images.example.com/menus/brunch.jpeg"},
+	})
+}
+
+func TestMaxJobBytes(t *testing.T) {
+	jobs := [][]string{{"f", "gallery/2019/tokyo/shibuya-crossing.jpg"}, {"p", "thumb", "960x540#"}}
+	payload, _ := json.Marshal(jobs)
+	target := signedURL(t, testSecret, jobs, ".jpg")
+	want := "/insecure/rs:fill:960:540:g:ce/ar:1/plain/https://images.example.com/gallery/2019/tokyo/shibuya-crossing.jpg"
+	testServe(t, func(config *Config) { config.MaxJobBytes = len(payload) }, []serveTest{
+		{"exactly the limit", target, nil, http.StatusOK, want},
+	})
+	testServe(t, func(config *Config) { config.MaxJobBytes = len(payload) + 1 }, []serveTest{
+		{"just under the limit", target, nil, http.StatusOK, want},
+	})
+	testServe(t, func(config *Config) { config.MaxJobBytes = len(payload) - 1 }, []serveTest{
+		{"one byte over", target, nil, http.StatusBadRequest, ""},
+	})
+
+	// rejected from its encoded length, whatever it decodes to
+	huge := "/media/" + strings.Repeat("W1siZiIsIngiXV0", 4000) + ".jpg?sha=0123456789abcdef"
+	handler, _ := newTestHandler(t, func(config *Config) {
+		config.MaxJobBytes = 1024
+		config.EnableMetrics = true
+	})
+	if rw := serve(handler, huge, nil); rw.Code != http.StatusBadRequest {
+		t.Errorf("oversized payload status %d, want %d", rw.Code, http.StatusBadRequest)
+	}
+	if got := handler.(*Dragonfly2imgproxy).Collector(); got.Base64Errors != 0 {
+		t.Errorf("oversized payload decoded, %d base64 errors", got.Base64Errors)
+	}
+
+	config := testConfig()
+	config.MaxJobBytes = -1
+	if _, err := New(context.Background(), &nextHandler{}, config, "test"); err == nil {
+		t.Error("New accepted a negative MaxJobBytes")
+	}
+}
+
+func TestConvertModes(t *testing.T) {
+	const browserAccept = "image/avif,image/webp,image/apng,*/*;q=0.8"
+	target := signedURL(t, testSecret, [][]string{{"f", "blog/covers/launch-day.png"}, {"p", "thumb", "1200x630#"}}, ".png")
+	for _, test := range []struct {
+		query  string
+		accept string // sent by the client, empty for none
+		want   string
+	}{
+		{"", browserAccept, browserAccept},
+		{"&convert=auto", browserAccept, browserAccept},
+		{"&convert=auto", "", ""},
+		{"&convert=false", browserAccept, ""},
+		{"&convert=true", "image/png", "image/webp"},
+		{"&convert=true", "", "image/webp"},
+	} {
+		header := http.Header{}
+		if len(test.accept) > 0 {
+			header.Set("Accept", test.accept)
+		}
+		handler, next := newTestHandler(t, nil)
+		if rw := serve(handler, target+test.query, header); rw.Code != http.StatusOK {
+			t.Fatalf("%q: status %d", test.query, rw.Code)
+		}
+		if got := next.req.Header.Get("Accept"); got != test.want {
+			t.Errorf("%q with Accept %q: forwarded Accept %q, want %q", test.query, test.accept, got, test.want)
+		}
+		if next.req.URL.RawQuery != "" {
+			t.Errorf("%q: convert forwarded in %q", test.query, next.req.URL.RawQuery)
+		}
+	}
+}
+
+func TestForceAccept(t *testing.T) {
+	const clientAccept = "image/webp,image/*;q=0.8"
+	target := signedURL(t, testSecret, [][]string{{"f", "venues/hall-b/seating.png"}}, ".png")
+	for _, test := range []struct {
+		query string
+		want  string
+	}{
+		{"", "image/avif,image/webp"},               // forced without convert
+		{"&convert=true", "image/avif,image/webp"},  // forced instead of plain webp
+		{"&convert=auto", clientAccept},             // client Accept kept
+		{"&convert=false", ""},                      // cleared over the forced one
+		{"&convert=maybe", "image/avif,image/webp"}, // unknown values act like no convert
+	} {
+		handler, next := newTestHandler(t, func(config *Config) { config.ForceAccept = "image/avif,image/webp" })
+		serve(handler, target+test.query, http.Header{"Accept": {clientAccept}})
+		if got := next.req.Header.Get("Accept"); got != test.want {
+			t.Errorf("%q: forwarded Accept %q, want %q", test.query, got, test.want)
+		}
+	}
+}
+
+func TestStripAcceptEncoding(t *testing.T) {
+	target := signedURL(t, testSecret, [][]string{{"f", "maps/floor-3.svg"}, {"p", "thumb", "800x"}}, ".svg")
+	client := http.Header{"Accept": {"image/webp,*/*"}, "Accept-Encoding": {"gzip, br"}}
+
+	// kept by default, even when convert=false clears Accept
+	for _, query := range []string{"", "&convert=true", "&convert=false"} {
+		handler, next := newTestHandler(t, nil)
+		serve(handler, target+query, client.Clone())
+		if got := next.req.Header.Get("Accept-Encoding"); got != "gzip, br" {
+			t.Errorf("%q: forwarded Accept-Encoding %q", query, got)
+		}
+	}
+
+	strict := func(config *Config) { config.StripAcceptEncoding = true }
+	handler, next := newTestHandler(t, strict)
+	serve(handler, target+"&convert=false", client.Clone())
+	if values, ok := next.req.Header["Accept-Encoding"]; ok {
+		t.Errorf("convert=false forwarded Accept-Encoding %q", values)
+	}
+	handler, next = newTestHandler(t, strict)
+	serve(handler, target+"&convert=auto", client.Clone())
+	if got := next.req.Header.Get("Accept-Encoding"); got != "gzip, br" {
+		t.Errorf("convert=auto forwarded Accept-Encoding %q", got)
+	}
+}
+
+func TestConvertCaseInsensitive(t *testing.T) {
+	target := signedURL(t, testSecret, [][]string{{"f", "gallery/2026/opening-night.jpg"}, {"p", "thumb", "900x"}}, ".jpg")
+	const clientAccept = "image/avif,image/webp,*/*"
+	forwarded := map[string]string{
+		"False": "",
+		"FALSE": "",
+		"0":     "",
+		"No":    "",
+		"TRUE":  "image/webp",
+		"yes":   "image/webp",
+		"1":     "image/webp",
+		"Auto":  clientAccept,
+	}
+	for value, want := range forwarded {
+		handler, next := newTestHandler(t, nil)
+		serve(handler, target+"&convert="+value, http.Header{"Accept": {clientAccept}})
+		if got := next.req.Header.Get("Accept"); got != want {
+			t.Errorf("convert=%s: forwarded Accept %q, want %q", value, got, want)
+		}
+	}
+
+	// PreferAvif stays off for any spelling of false or true
+	for _, value := range []string{"FALSE", "0", "True", "1"} {
+		handler, next := newTestHandler(t, func(config *Config) { config.PreferAvif = true })
+		serve(handler, target+"&convert="+value, http.Header{"Accept": {clientAccept}})
+		if path := next.req.URL.EscapedPath(); strings.Contains(path, "f:avif") {
+			t.Errorf("convert=%s: avif forced in %s", value, path)
+		}
+	}
+}
+
+func TestNewHandler(t *testing.T) {
+	jobs := [][]string{{"f", "press/kit/wordmark.svg"}, {"p", "thumb", "320x"}}
+	target := signedURL(t, testSecret, jobs, ".svg")
+	const want = "/insecure/rs:fit:320:0/ar:1/plain/https://images.example.com/press/kit/wordmark.svg"
+
+	config := testConfig()
+	config.EnableMetrics = true
+	next := &nextHandler{}
+	concrete, err := NewHandler(context.Background(), next, config, "concrete")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve(concrete, target, nil)
+	if !next.called || next.req.URL.EscapedPath() != want {
+		t.Fatalf("NewHandler handler forwarded %v, want %s", next.req, want)
+	}
+	if got := concrete.Collector(); got.Requests != 1 || got.Responses[http.StatusOK] != 1 {
+		t.Errorf("Collector on the concrete type: %+v", got)
+	}
+
+	// New wraps the same handler for the plugin interface
+	next = &nextHandler{}
+	handler, err := New(context.Background(), next, config, "plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rw := serve(handler, target, nil); rw.Code != http.StatusOK || !next.called || next.req.URL.EscapedPath() != want {
+		t.Errorf("New handler status %d, forwarded %v, want %s", rw.Code, next.req, want)
+	}
+	if _, ok := handler.(*Dragonfly2imgproxy); !ok {
+		t.Errorf("New returned %T", handler)
+	}
+
+	config = testConfig()
+	config.DragonflySecret = ""
+	if concrete, err := NewHandler(context.Background(), &nextHandler{}, config, "test"); err == nil || concrete != nil {
+		t.Errorf("NewHandler without a secret: %v, %v", concrete, err)
+	}
+	if handler, err := New(context.Background(), &nextHandler{}, config, "test"); err == nil || handler != nil {
+		t.Errorf("New without a secret: %v, %v", handler, err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := testConfig()
+	valid.Secrets = map[string]string{"shop": "shop-secret"}
+	valid.Prefixes = map[string]string{"cdn": "https://cdn.example.net/assets"}
+	valid.SkipProcessingFormats = []string{".SVG"}
+	valid.PathPrefix = "assets"
+	valid.RedirectMode = true
+	valid.ImgproxyBaseURL = "https://imgproxy.example.com/"
+	valid.ImgproxyKey, valid.ImgproxySalt = "943b421c9eb07c83", "520f986b998545b4"
+	valid.DefaultResize = "2000x2000>"
+	valid.ProcessTimeout = "2s"
+	valid.Gravity, valid.MissingShaStatus = "", 0 // left to the defaults
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("valid config: %v", err)
+	}
+	// checked with the defaults filled in, which stay out of the caller's config
+	if valid.PathPrefix != "assets" || valid.Gravity != "" || valid.SkipProcessingFormats[0] != ".SVG" ||
+		valid.Prefixes["cdn"] != "https://cdn.example.net/assets" || valid.MissingShaStatus != 0 {
+		t.Errorf("Validate changed the config: %+v", valid)
+	}
+	if _, err := New(context.Background(), &nextHandler{}, valid, "test"); err != nil {
+		t.Errorf("New rejected a valid config: %v", err)
+	}
+	if valid.PathPrefix != "assets" || valid.Gravity != "" || valid.SkipProcessingFormats[0] != ".SVG" {
+		t.Errorf("New changed the config: %+v", valid)
+	}
+
+	// each change makes testConfig invalid, keyed by the setting in the error
+	invalid := map[string]func(*Config){
+		"DragonflySecret":       func(c *Config) { c.DragonflySecret = "" },
+		"ErrorFormat":           func(c *Config) { c.ErrorFormat = "xml" },
+		"AdditionalSecrets":     func(c *Config) { c.AdditionalSecrets = []string{"previous", ""} },
+		`Secrets["shop"]`:       func(c *Config) { c.Secrets = map[string]string{"shop": ""} },
+		"SourceURLMode":         func(c *Config) { c.SourceURLMode = "hex" },
+		"SourceType":            func(c *Config) { c.SourceType = "s3" },
+		"URLPrefix":             func(c *Config) { c.URLPrefix = "images.example.com/" },
+		`Prefixes["cdn"]`:       func(c *Config) { c.Prefixes = map[string]string{"cdn": "cdn.example.net/assets"} },
+		"HashAlgorithm":         func(c *Config) { c.HashAlgorithm = "md5" },
+		"SignatureLength":       func(c *Config) { c.SignatureLength = 65 },
+		"ExpirySeconds":         func(c *Config) { c.ExpirySeconds = -60 },
+		"DefaultPreset":         func(c *Config) { c.DefaultPreset = "hero banner" },
+		"FormatByPathRegex":     func(c *Config) { c.FormatByPathRegex = map[string]string{`[`: "webp"} },
+		"JpegQuality":           func(c *Config) { c.JpegQuality = 101 },
+		"WebpQuality":           func(c *Config) { c.WebpQuality = -1 },
+		"Gravity":               func(c *Config) { c.Gravity = "up" },
+		"SkipProcessingFormats": func(c *Config) { c.SkipProcessingFormats = []string{"psd"} },
+		"ResizingAlgorithm":     func(c *Config) { c.ResizingAlgorithm = "bicubic" },
+		"DefaultResize":         func(c *Config) { c.DefaultResize = "big" },
+		"MissingShaStatus":      func(c *Config) { c.MissingShaStatus = http.StatusFound },
+		"MaxJobBytes":           func(c *Config) { c.MaxJobBytes = -1 },
+		"MaxHeight":             func(c *Config) { c.MaxHeight = -1 },
+		"AllowedExtensions":     func(c *Config) { c.AllowedExtensions = []string{"tar.gz"} },
+		"ImgproxyBaseURL":       func(c *Config) { c.AbsoluteRewrite = true },
+		"ImgproxySalt":          func(c *Config) { c.ImgproxyKey = "943b421c9eb07c83" },
+		"ImgproxyKey":           func(c *Config) { c.ImgproxyKey, c.ImgproxySalt = "not hex", "520f986b998545b4" },
+		"ProcessTimeout":        func(c *Config) { c.ProcessTimeout = "soon" },
+	}
+	for setting, configure := range invalid {
+		config := testConfig()
+		configure(config)
+		err := config.Validate()
+		if err == nil || !strings.Contains(err.Error(), setting) {
+			t.Errorf("%s: Validate returned %v", setting, err)
+			continue
+		}
+		if _, newErr := New(context.Background(), &nextHandler{}, config, "test"); newErr == nil || newErr.Error() != err.Error() {
+			t.Errorf("%s: New returned %v, Validate %v", setting, newErr, err)
+		}
+	}
+}
+
+func TestGravityOffsets(t *testing.T) {
+	team := []string{"f", "about/team-offsite.jpg"}
+	fill := func(geometry string) [][]string { return [][]string{team, {"p", "thumb", geometry}} }
+	testURLs(t, nil, []urlTest{
+		{"fill without offsets", fill("400x300#"), "/insecure/rs:fill:400:300:g:ce/ar:1/plain/https://images.example.com/about/team-offsite.jpg", false},
+		{"fill with offsets", fill("400x300#+10+20"), "/insecure/rs:fill:400:300/g:ce:10:20/ar:1/plain/https://images.example.com/about/team-offsite.jpg", false},
+		{"mixed signs", fill("400x300#-15+5"), "/insecure/rs:fill:400:300/g:ce:-15:5/ar:1/plain/https://images.example.com/about/team-offsite.jpg", false},
+		{"offsets on a fit", fill("400x300>+10+20"), "", true},
+		{"offsets on a force", fill("400x300!+10+20"), "", true},
+		{"one offset", fill("400x300#+10"), "", true},
+		{"offsets without a sign", fill("400x300#10+20"), "", true},
+	})
+	testURLs(t, func(config *Config) { config.Gravity = "we" }, []urlTest{
+		{"configured gravity", fill("160x90#+0-30"), "/insecure/rs:fill:160:90/g:we:0:-30/ar:1/plain/https://images.example.com/about/team-offsite.jpg", false},
+	})
+
+	// the offsets are signed with the geometry
+	testServe(t, nil, []serveTest{
+		{"offsets changed", withSHA(signedURL(t, testSecret, fill("400x300#+90+20"), ".jpg"), CalculateSHA(testSecret, fill("400x300#+10+20"))), nil, http.StatusForbidden, ""},
+	})
+}
+
+func TestSourceFormatDetection(t *testing.T) {
+	const prefix = "https://cdn.example.com/legacy.gif/"
+	thumb := func(file string) [][]string { return [][]string{{"f", file}, {"p", "thumb", "150x150>"}} }
+	testURLs(t, func(config *Config) { config.URLPrefix = prefix }, []urlTest{
+		{"png under a .gif prefix", thumb("badges/gold.png"), "/insecure/rs:fit:150:150:0/ar:1/plain/" + prefix + "badges/gold.png", false},
+		{"gif file", thumb("badges/spin.gif"), "/insecure/rs:fit:150:150:0/ar:1/f:gif/plain/" + prefix + "badges/spin.gif", false},
+		{"upper case gif", thumb("badges/SPIN.Gif"), "/insecure/rs:fit:150:150:0/ar:1/f:gif/plain/" + prefix + "badges/SPIN.Gif", false},
+		{".gif directory", thumb("sprites.gif/star.webp"), "/insecure/rs:fit:150:150:0/ar:1/plain/" + prefix + "sprites.gif/star.webp", false},
+	})
+	testURLs(t, func(config *Config) { config.Prefixes = map[string]string{"anim": "https://anim.gif.example.com/"} }, []urlTest{
+		{"prefix key host with .gif", [][]string{{"f", "anim", "frames/01.jpg"}, {"p", "thumb", "150x150>"}}, "/insecure/rs:fit:150:150:0/ar:1/plain/https://anim.gif.example.com/frames/01.jpg", false},
+	})
+	testURLs(t, func(config *Config) {
+		config.URLPrefix, config.ForceAvifFormat = "https://img.example.com/x.avif/", true
+	}, []urlTest{
+		{"jpg under an .avif prefix", thumb("hero.jpg"), "/insecure/rs:fit:150:150:0/ar:1/plain/https://img.example.com/x.avif/hero.jpg", false},
+		{"avif file", thumb("hero.avif"), "/insecure/rs:fit:150:150:0/ar:1/f:avif/plain/https://img.example.com/x.avif/hero.avif", false},
+	})
+}
+
+func TestTenantSecrets(t *testing.T) {
+	jobs := [][]string{{"f", "storefront/banner-sale.webp"}, {"p", "thumb", "1440x400#"}}
+	const want = "/insecure/rs:fill:1440:400:g:ce/ar:1/plain/https://images.example.com/storefront/banner-sale.webp"
+	tenants := func(config *Config) {
+		config.Secrets = map[string]string{"north": "n0rth-s3cret", "south": "s0uth-s3cret"}
+	}
+	testServe(t, tenants, []serveTest{
+		{"valid tenant sha", signedURL(t, "n0rth-s3cret", jobs, ".webp") + "&tenant=north", nil, http.StatusOK, want},
+		{"other tenant", signedURL(t, "s0uth-s3cret", jobs, ".webp") + "&tenant=south", nil, http.StatusOK, want},
+		{"cross-tenant mismatch", signedURL(t, "s0uth-s3cret", jobs, ".webp") + "&tenant=north", nil, http.StatusForbidden, ""},
+		{"default secret without tenant", signedURL(t, testSecret, jobs, ".webp"), nil, http.StatusOK, want},
+		{"tenant secret without tenant", signedURL(t, "n0rth-s3cret", jobs, ".webp"), nil, http.StatusForbidden, ""},
+		{"default secret with a tenant", signedURL(t, testSecret, jobs, ".webp") + "&tenant=north", nil, http.StatusForbidden, ""},
+		{"unknown tenant", signedURL(t, testSecret, jobs, ".webp") + "&tenant=east", nil, http.StatusBadRequest, ""},
+	})
+
+	handler, next := newTestHandler(t, func(config *Config) {
+		tenants(config)
+		config.PassthroughParams = []string{"tenant"}
+	})
+	serve(handler, signedURL(t, "s0uth-s3cret", jobs, ".webp")+"&tenant=south", nil)
+	if next.req.URL.RawQuery != "" {
+		t.Errorf("tenant passed through in %q", next.req.URL.RawQuery)
+	}
+
+	config := testConfig()
+	config.Secrets = map[string]string{"north": "n0rth-s3cret", "west": ""}
+	if _, err := New(context.Background(), &nextHandler{}, config, "test"); err == nil {
+		t.Error("New accepted an empty tenant secret")
+	}
+}
+
+func TestAdditionalSecrets(t *testing.T) {
+	jobs := [][]string{{"f", "podcasts/ep-118/cover.png"}, {"p", "thumb", "300x300"}}
+	handler, next := newTestHandler(t, func(config *Config) {
+		config.DragonflySecret = "2024-q3"
+		config.AdditionalSecrets = []string{"2024-q2", "2024-q1"}
+		config.Secrets = map[string]string{"label": "label-only"}
+	})
+	for secret, accepted := range map[string]bool{"2024-q3": true, "2024-q2": true, "2024-q1": true, "2023-q4": false} {
+		next.called = false
+		rw := serve(handler, signedURL(t, secret, jobs, ".png"), nil)
+		if accepted && (rw.Code != http.StatusOK || next.req.URL.Path != "/insecure/rs:fit:300:300/ar:1/plain/https://images.example.com/podcasts/ep-118/cover.png") {
+			t.Errorf("secret %s: status %d, body %q", secret, rw.Code, rw.Body.String())
+		}
+		if !accepted && (rw.Code != http.StatusForbidden || next.called) {
+			t.Errorf("retired secret %s: status %d", secret, rw.Code)
+		}
+	}
+	// rotated secrets only apply without a tenant
+	if rw := serve(handler, signedURL(t, "2024-q2", jobs, ".png")+"&tenant=label", nil); rw.Code == http.StatusOK {
+		t.Error("AdditionalSecrets accepted for a tenant")
+	}
+
+	config := testConfig()
+	config.AdditionalSecrets = []string{"old", ""}
+	if _, err := NewHandler(context.Background(), &nextHandler{}, config, "test"); err == nil {
+		t.Error("NewHandler accepted an empty additional secret")
+	}
+}
+
+func TestAllowedExtensions(t *testing.T) {
+	jobs := [][]string{{"f", "scans/blueprint-7.bmp"}, {"p", "thumb", "1200x"}}
+	const want = "/insecure/rs:fit:1200:0/ar:1/plain/https://images.example.com/scans/blueprint-7.bmp"
+	testServe(t, func(config *Config) { config.AllowedExtensions = []string{".bmp", "tiff"} }, []serveTest{
+		{"configured extension", signedURL(t, testSecret, jobs, ".bmp"), nil, http.StatusOK, want},
+		{"without dot", signedURL(t, testSecret, jobs, ".TIFF"), nil, http.StatusOK, want},
+		{"no extension", signedURL(t, testSecret, jobs, ""), nil, http.StatusOK, want},
+		{"default extension no longer stripped", signedURL(t, testSecret, jobs, ".png"), nil, http.StatusBadRequest, ""},
+	})
+	testServe(t, nil, []serveTest{
+		{"unknown extension by default", signedURL(t, testSecret, jobs, ".bmp"), nil, http.StatusBadRequest, ""},
+	})
+
+	config := testConfig()
+	config.AllowedExtensions = []string{".bmp"}
+	srcset, err := config.BuildSrcset("", jobs[:1], []int{800})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(srcset, ".bmp?sha=") {
+		t.Errorf("srcset %q, want the .bmp extension", srcset)
+	}
+
+	for _, extensions := range [][]string{{"."}, {".tar.gz"}, {"p*g"}} {
+		config := testConfig()
+		config.AllowedExtensions = extensions
+		if _, err := New(context.Background(), &nextHandler{}, config, "test"); err == nil {
+			t.Errorf("AllowedExtensions %q accepted", extensions)
+		}
+		if _, err := config.BuildSrcset("", jobs[:1], []int{800}); err == nil {
+			t.Errorf("BuildSrcset accepted AllowedExtensions %q", extensions)
+		}
+	}
+}
+
+func TestResizingAlgorithm(t *testing.T) {
+	cases := []struct {
+		algorithm string
+		jobs      [][]string
+		want      string
+	}{
+		{"lanczos2", [][]string{{"f", "fonts/specimen.png"}, {"p", "thumb", "900x"}}, "/insecure/rs:fit:900:0/ar:1/ra:lanczos2/plain/https://images.example.com/fonts/specimen.png"},
+		{"nearest", [][]string{{"f", "sprites/hero.png"}, {"p", "thumb", "64x64#"}}, "/insecure/rs:fill:64:64:g:ce/ar:1/ra:nearest/plain/https://images.example.com/sprites/hero.png"},
+		// nothing is resized, the algorithm is left out
+		{"cubic", [][]string{{"f", "sprites/hero.png"}, {"p", "rotate", "90"}}, "/insecure/rot:90/ar:1/plain/https://images.example.com/sprites/hero.png"},
+		{"", [][]string{{"f", "fonts/specimen.png"}, {"p", "thumb", "900x"}}, "/insecure/rs:fit:900:0/ar:1/plain/https://images.example.com/fonts/specimen.png"},
+	}
+	for _, c := range cases {
+		config := testConfig()
+		config.ResizingAlgorithm = c.algorithm
+		got, err := generate_imgproxy_url(config.normalize(), c.jobs, requestOptions{})
+		if err != nil || got != c.want {
+			t.Errorf("%q %v: got %q, %v, want %q", c.algorithm, c.jobs, got, err, c.want)
+		}
+	}
+
+	config := testConfig()
+	config.ResizingAlgorithm = "bicubic"
+	if _, err := New(context.Background(), &nextHandler{}, config, "test"); err == nil {
+		t.Error("New accepted ResizingAlgorithm bicubic")
+	}
+}
+
+func TestPixelate(t *testing.T) {
+	for args, want := range map[string]string{"12": "pix:12", "1": "pix:1", "0032": "pix:32"} {
+		if got, err := pixelateOperation([]string{args}); err != nil || got != want {
+			t.Errorf("pixelate %s = %q, %v, want %q", args, got, err, want)
+		}
+	}
+	for _, args := range [][]string{{}, {"0"}, {"-8"}, {"4.5"}, {"8", "8"}, {"big"}} {
+		if got, err := pixelateOperation(args); err == nil {
+			t.Errorf("pixelate %q accepted as %q", args, got)
+		}
+	}
+
+	// faces blurred out of a press photo, the rejected size is never forwarded
+	jobs := [][]string{{"f", "press/2024/crowd.jpg"}, {"p", "thumb", "1024x"}, {"p", "pixelate", "16"}}
+	handler, next := newTestHandler(t, nil)
+	if rw := serve(handler, signedURL(t, testSecret, jobs, ".jpg"), nil); rw.Code != http.StatusOK ||
+		next.req.URL.Path != "/insecure/rs:fit:1024:0/pix:16/ar:1/plain/https://images.example.com/press/2024/crowd.jpg" {
+		t.Errorf("status %d, forwarded %v", rw.Code, next.req)
+	}
+	next.called = false
+	jobs[2] = []string{"p", "pixelate", "0"}
+	if rw := serve(handler, signedURL(t, testSecret, jobs, ".jpg"), nil); rw.Code == http.StatusOK || next.called {
+		t.Errorf("pixelate 0: status %d", rw.Code)
+	}
+}
+
+func TestAdjustments(t *testing.T) {
+	poster := []string{"f", "events/jazz-night/poster.jpg"}
+	adjust := func(name, value string) (string, error) {
+		return generate_imgproxy_url(testConfig().normalize(), [][]string{poster, {"p", name, value}}, requestOptions{})
+	}
+	for _, c := range []struct{ name, value, option string }{
+		{"brightness", "10", "br:10"},
+		{"brightness", "-255", "br:-255"},
+		{"brightness", "+40", "br:40"},
+		{"brightness", "12.0", "br:12"},
+		{"contrast", "1.2", "co:1.2"},
+		{"contrast", "0", "co:0"},
+		{"contrast", "1.50", "co:1.5"},
+		{"saturation", "0.8", "sa:0.8"},
+		{"saturation", "10", "sa:10"},
+		{"saturation", "2e-1", "sa:0.2"},
+	} {
+		want := "/insecure/" + c.option + "/ar:1/plain/https://images.example.com/events/jazz-night/poster.jpg"
+		if got, err := adjust(c.name, c.value); err != nil || got != want {
+			t.Errorf("%s %s: got %q, %v, want %q", c.name, c.value, got, err, want)
+		}
+	}
+	for name, values := range map[string][]string{
+		"brightness": {"256", "-256", "1.5", "bright", ""},
+		"contrast":   {"-0.1", "10.5", "NaN", "Inf", "1,2"},
+		"saturation": {"-1", "1e3", "+Inf", "none"},
+	} {
+		for _, value := range values {
+			if got, err := adjust(name, value); err == nil {
+				t.Errorf("%s %q accepted as %q", name, value, got)
+			}
+		}
+	}
+	if _, err := generate_imgproxy_url(testConfig().normalize(), [][]string{poster, {"p", "contrast"}}, requestOptions{}); err == nil {
+		t.Error("contrast without a value accepted")
+	}
+
+	// a combined grade is signed and forwarded in job order
+	graded := [][]string{poster, {"p", "thumb", "800x"}, {"p", "saturation", "0"}, {"p", "contrast", "1.25"}, {"p", "brightness", "-20"}}
+	testServe(t, nil, []serveTest{
+		{"combined", signedURL(t, testSecret, graded, ".jpg"), nil, http.StatusOK, "/insecure/rs:fit:800:0/sa:0/co:1.25/br:-20/ar:1/plain/https://images.example.com/events/jazz-night/poster.jpg"},
+		{"grade changed", withSHA(signedURL(t, testSecret, graded[:4], ".jpg"), CalculateSHA(testSecret, graded)), nil, http.StatusForbidden, ""},
+	})
+}
+
+func TestPooledSignature(t *testing.T) {
+	config := testConfig()
+	config.AdditionalSecrets = []string{"retired-2023"}
+	config.Secrets = map[string]string{"wholesale": "wholesale-key"}
+	handler, err := NewHandler(context.Background(), &nextHandler{}, config, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// concurrent signers each get a hash reset to the key, never one holding
+	// another request's message
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; n < 50; n++ {
+				jobs := [][]string{{"f", "menus/week-" + strconv.Itoa(n) + ".png"}, {"p", "thumb", strconv.Itoa(i+1) + "00x"}}
+				for _, secret := range []string{testSecret, "retired-2023", "wholesale-key"} {
+					if got, want := handler.signature(secret, jobs), CalculateSHA(secret, jobs); got != want {
+						t.Errorf("%s %v: pooled %s, want %s", secret, jobs, got, want)
+						return
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	config.HashAlgorithm = "sha512"
+	config.SignatureLength = 64
+	handler, err = NewHandler(context.Background(), &nextHandler{}, config, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs := [][]string{{"f", "menus/week-1.png"}}
+	if got, want := handler.signature(testSecret, jobs), calculateSHA(testSecret, jobs, "sha512", 64); got != want {
+		t.Errorf("sha512: pooled %s, want %s", got, want)
+	}
+}
+
+func BenchmarkCalculateSHA(b *testing.B) {
+	jobs := [][]string{{"f", "menus/week-12.png"}, {"p", "thumb", "400x300#"}, {"p", "rotate", "90"}}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		calculateSHA(testSecret, jobs, defaultHashAlgorithm, defaultSignatureLength)
+	}
+}
+
+func BenchmarkPooledSignature(b *testing.B) {
+	handler, err := NewHandler(context.Background(), &nextHandler{}, testConfig(), "test")
+	if err != nil {
+		b.Fatal(err)
+	}
+	jobs := [][]string{{"f", "menus/week-12.png"}, {"p", "thumb", "400x300#"}, {"p", "rotate", "90"}}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		handler.signature(testSecret, jobs)
+	}
+}
+
+func TestHMACKey(t *testing.T) {
+	messages := [][]byte{nil, []byte("fcatalog/chair.pngpthumb640x"), bytes.Repeat([]byte("long message "), 40)}
+	// keys around the sha256 and sha512 block sizes, longer ones are hashed first
+	for _, secret := range []string{"k", strings.Repeat("s", 64), strings.Repeat("s", 65), strings.Repeat("x", 128), strings.Repeat("x", 200)} {
+		for algorithm := range hashAlgorithms {
+			key, err := newHMACKey(secret, algorithm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// twice, the second time from pooled hashes
+			for round := 0; round < 2; round++ {
+				for _, message := range messages {
+					h := hmacHash(secret, algorithm)
+					h.Write(message)
+					if got, want := key.sum(message), h.Sum(nil); !bytes.Equal(got, want) {
+						t.Errorf("%s key of %d bytes, message %q: %x, want %x", algorithm, len(secret), message, got, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkServeHTTP(b *testing.B) {
+	handler, _ := newTestHandler(b, nil)
+	target := signedURL(b, testSecret, [][]string{{"f", "catalog/chair.png"}, {"p", "thumb", "640x480#"}}, ".png")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		serve(handler, target, nil)
+	}
+}
+
+func TestHandlerSHA(t *testing.T) {
+	jobLists := [][][]string{
+		{{"f", "atlas/tiles/12/654/1583.png"}},
+		{{"f", "atlas/tiles/12/654/1583.png"}, {"p", "thumb", "256x256#"}, {"e", "1767225600"}},
+		{},
+	}
+	for _, c := range []struct {
+		algorithm string
+		length    int
+	}{{"sha1", 40}, {"sha256", 16}, {"sha512", 128}, {"", 0}} {
+		handler, err := NewHandler(context.Background(), &nextHandler{}, &Config{
+			DragonflySecret: "tiles-2024",
+			URLPrefix:       testPrefix,
+			HashAlgorithm:   c.algorithm,
+			SignatureLength: c.length,
+		}, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		algorithm, length := c.algorithm, c.length
+		if algorithm == "" { // defaults filled in by NewHandler
+			algorithm, length = defaultHashAlgorithm, defaultSignatureLength
+		}
+		for _, jobs := range jobLists {
+			if got, want := handler.sha(jobs), calculateSHA("tiles-2024", jobs, algorithm, length); got != want {
+				t.Errorf("%s/%d %v: sha %s, calculateSHA %s", algorithm, length, jobs, got, want)
+			}
+		}
+	}
+}
+
+func TestHandlerSignatures(t *testing.T) {
+	config := testConfig()
+	config.AdditionalSecrets = []string{"before-rotation"}
+	config.Secrets = map[string]string{"museum": "museum-key"}
+	handler, err := NewHandler(context.Background(), &nextHandler{}, config, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs := [][]string{{"f", "exhibits/vase-03.jpg"}}
+	signatures := func(target string) []string {
+		got, err := handler.signatures(httptest.NewRequest(http.MethodGet, target, nil), jobs)
+		if err != nil {
+			t.Fatalf("%s: %v", target, err)
+		}
+		return got
+	}
+	if got, want := signatures("/media/x"), []string{handler.sha(jobs), CalculateSHA("before-rotation", jobs)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("without tenant %q, want %q", got, want)
+	}
+	if got, want := signatures("/media/x?tenant=museum"), []string{CalculateSHA("museum-key", jobs)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("museum tenant %q, want %q", got, want)
+	}
+	if _, err := handler.signatures(httptest.NewRequest(http.MethodGet, "/media/x?tenant=gallery", nil), jobs); err == nil {
+		t.Error("unknown tenant signed")
+	}
+}
+
+func TestFocusPoint(t *testing.T) {
+	portrait := [][]string{{"f", "team/2024/ana-lopez.jpg"}, {"p", "thumb", "400x400#"}}
+	target := signedURL(t, testSecret, portrait, ".jpg")
+	const source = "/ar:1/plain/https://images.example.com/team/2024/ana-lopez.jpg"
+	testServe(t, nil, []serveTest{
+		{"focus point", target + "&focus=0.5,0.25", nil, http.StatusOK, "/insecure/rs:fill:400:400:g:fp:0.5:0.25" + source},
+		{"bounds", target + "&focus=0,1", nil, http.StatusOK, "/insecure/rs:fill:400:400:g:fp:0:1" + source},
+		{"normalized", target + "&focus=.50,0.330", nil, http.StatusOK, "/insecure/rs:fill:400:400:g:fp:0.5:0.33" + source},
+		{"no focus", target, nil, http.StatusOK, "/insecure/rs:fill:400:400:g:ce" + source},
+		{"above 1", target + "&focus=1.5,0.5", nil, http.StatusBadRequest, ""},
+		{"negative", target + "&focus=0.5,-0.1", nil, http.StatusBadRequest, ""},
+		{"one coordinate", target + "&focus=0.5", nil, http.StatusBadRequest, ""},
+		{"three coordinates", target + "&focus=0.1,0.2,0.3", nil, http.StatusBadRequest, ""},
+		{"not a number", target + "&focus=left,top", nil, http.StatusBadRequest, ""},
+		{"nan", target + "&focus=NaN,0.5", nil, http.StatusBadRequest, ""},
+	})
+
+	// the focus point replaces signed offsets, extend keeps the configured gravity
+	offset := [][]string{{"f", "team/2024/ana-lopez.jpg"}, {"p", "thumb", "300x200#+15-5"}}
+	fit := [][]string{{"f", "team/2024/ana-lopez.jpg"}, {"p", "thumb", "300x200"}}
+	testServe(t, func(config *Config) { config.Gravity = "no" }, []serveTest{
+		{"with offsets", signedURL(t, testSecret, offset, ".jpg") + "&focus=0.2,0.8", nil, http.StatusOK, "/insecure/rs:fill:300:200:g:fp:0.2:0.8" + source},
+		{"extend", signedURL(t, testSecret, fit, ".jpg") + "&focus=0.2,0.8&extend=true", nil, http.StatusOK, "/insecure/rs:fit:300:200/ar:1/ex:1:no/plain/https://images.example.com/team/2024/ana-lopez.jpg"},
+	})
+}
+
+func TestSourcePathSegments(t *testing.T) {
+	fetch := func(filePath string) (string, error) {
+		return generate_imgproxy_url(testConfig().normalize(), [][]string{{"f", filePath}}, requestOptions{})
+	}
+	for filePath, want := range map[string]string{
+		"public/my folder/img.jpg":            "public/my%20folder/img.jpg",
+		"public/Q&A #3/faq (1).png":           "public/Q&A%20%233/faq%20%281%29.png",
+		"exports/50% off/ünïcode/banner.webp": "exports/50%25%20off/%C3%BCn%C3%AFcode/banner.webp",
+		"plain/dirs/stay.jpg":                 "plain/dirs/stay.jpg",
+		"double//slash/./photo.jpg":           "double/slash/photo.jpg",
+		"menus/2024?draft=1/lunch+dinner.jpg": "menus/2024%3Fdraft=1/lunch+dinner.jpg",
+		"/rooted/archive 1998/scan.jpg":       "/rooted/archive%201998/scan.jpg",
+	} {
+		got, err := fetch(filePath)
+		if want = "/insecure/ar:1/plain/https://images.example.com/" + want; err != nil || got != want {
+			t.Errorf("%q: got %q, %v, want %q", filePath, got, err, want)
+		}
+	}
+
+	// the escaped segments reach imgproxy as one plain source
+	jobs := [][]string{{"f", "public/my folder/img.jpg"}, {"p", "thumb", "50x50"}}
+	handler, next := newTestHandler(t, nil)
+	if rw := serve(handler, signedURL(t, testSecret, jobs, ".jpg"), nil); rw.Code != http.StatusOK {
+		t.Fatalf("status %d", rw.Code)
+	}
+	if got, want := next.req.URL.RawPath, "/insecure/rs:fit:50:50/ar:1/plain/https://images.example.com/public/my%20folder/img.jpg"; got != want {
+		t.Errorf("forwarded %s, want %s", got, want)
+	}
+}
+
+func TestCustomEscape(t *testing.T) {
+	cases := []struct {
+		name, segment, query, want string
+	}{
+		// QueryEscape encodes & and = which a path keeps, and ? in both
+		{"ampersand and question mark", "tom&jerry?.png", "tom%26jerry%3F.png", "tom&jerry%3F.png"},
+		{"space", "summer sale.jpg", "summer+sale.jpg", "summer%20sale.jpg"},
+		{"plus", "c++ logo.svg", "c%2B%2B+logo.svg", "c++%20logo.svg"},
+		{"equals", "size=large.webp", "size%3Dlarge.webp", "size=large.webp"},
+		{"slash in a segment", "a/b.png", "a%2Fb.png", "a%2Fb.png"},
+		{"at sign", "logo@2x.png", "logo%402x.png", "logo%402x.png"},
+		{"hash and percent", "#1 100%.gif", "%231+100%25.gif", "%231%20100%25.gif"},
+	}
+	for _, c := range cases {
+		if got := url.QueryEscape(c.segment); got != c.query {
+			t.Errorf("%s: QueryEscape(%q) = %q, want %q", c.name, c.segment, got, c.query)
+		}
+		if got := customEscape(c.segment); got != c.want {
+			t.Errorf("%s: customEscape(%q) = %q, want %q", c.name, c.segment, got, c.want)
+		}
+		if unescaped, err := url.PathUnescape(c.want); err != nil || unescaped != c.segment {
+			t.Errorf("%s: %q unescapes to %q, %v", c.name, c.want, unescaped, err)
+		}
+	}
+
+	// imgproxy gets the filename back intact
+	jobs := [][]string{{"f", "cartoons/tom&jerry?.png"}}
+	testServe(t, nil, []serveTest{
+		{"filename", signedURL(t, testSecret, jobs, ".png"), nil, http.StatusOK, "/insecure/ar:1/plain/https://images.example.com/cartoons/tom&jerry%3F.png"},
+	})
+}
+
+func TestUseEmbeddedThumbnail(t *testing.T) {
+	jobs := [][]string{{"f", "camera-roll/IMG_4410.avif"}, {"p", "thumb", "160x160#"}}
+	for _, enabled := range []bool{true, false} {
+		config := testConfig()
+		config.UseEmbeddedThumbnail = enabled
+		got, err := generate_imgproxy_url(config.normalize(), jobs, requestOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if options := strings.Split(got, "/"); containsString(options, "eth:1") != enabled {
+			t.Errorf("UseEmbeddedThumbnail %v: %s", enabled, got)
+		}
+	}
+	// it is server side, a source without jobs gets it too
+	config := testConfig()
+	config.UseEmbeddedThumbnail = true
+	if got, _ := generate_imgproxy_url(config.normalize(), jobs[:1], requestOptions{}); got != "/insecure/ar:1/eth:1/plain/https://images.example.com/camera-roll/IMG_4410.avif" {
+		t.Errorf("fetch only: %s", got)
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func TestThumbDimensionRange(t *testing.T) {
+	resize := func(geometry string) (string, error) {
+		jobs := [][]string{{"f", "floorplans/unit-4b.png"}, {"p", "thumb", geometry}}
+		return generate_imgproxy_url(testConfig().normalize(), jobs, requestOptions{})
+	}
+	for geometry, want := range map[string]imgproxyResize{
+		"1x1":        {"fit", "1", "1", "", ""},
+		"65535x":     {"fit", "65535", "0", "", ""},
+		"x0480":      {"fit", "0", "480", "", ""},
+		"0001x0002#": {"fill", "1", "2", "g", "ce"},
+		"2048x1536>": {"fit", "2048", "1536", "0", ""},
+	} {
+		got, err := resize(geometry)
+		if err != nil {
+			t.Errorf("%s: %v", geometry, err)
+			continue
+		}
+		if resize := parseResize(t, got); resize != want {
+			t.Errorf("%s: %+v, want %+v", geometry, resize, want)
+		}
+	}
+	for _, geometry := range []string{"0x100", "100x0", "0x0#", "65536x", "99999999999999999999x", "x18446744073709551617"} {
+		if got, err := resize(geometry); err == nil {
+			t.Errorf("%s accepted as %s", geometry, got)
+		}
+	}
+}
+
+func TestPreferAvif(t *testing.T) {
+	hero := signedURL(t, testSecret, [][]string{{"f", "landing/hero-dusk.webp"}, {"p", "thumb", "1600x"}}, ".webp")
+	sticker := signedURL(t, testSecret, [][]string{{"f", "chat/stickers/party.gif"}}, ".gif")
+	icon := signedURL(t, testSecret, [][]string{{"f", "ui/icons/bell.svg"}, {"p", "thumb", "32x32"}}, ".svg")
+	chrome := http.Header{"Accept": {"image/avif,image/webp,image/apng,*/*;q=0.8"}}
+	legacy := http.Header{"Accept": {"image/webp,*/*"}}
+	const heroSource = "/ar:1/plain/https://images.example.com/landing/hero-dusk.webp"
+	testServe(t, func(config *Config) { config.PreferAvif = true }, []serveTest{
+		{"avif accepted", hero, chrome, http.StatusOK, "/insecure/rs:fit:1600:0/ar:1/f:avif/plain/https://images.example.com/landing/hero-dusk.webp"},
+		{"avif not accepted", hero, legacy, http.StatusOK, "/insecure/rs:fit:1600:0" + heroSource},
+		{"no accept", hero, nil, http.StatusOK, "/insecure/rs:fit:1600:0" + heroSource},
+		{"convert auto", hero + "&convert=auto", chrome, http.StatusOK, "/insecure/rs:fit:1600:0/ar:1/f:avif/plain/https://images.example.com/landing/hero-dusk.webp"},
+		{"convert false", hero + "&convert=false", chrome, http.StatusOK, "/insecure/rs:fit:1600:0" + heroSource},
+		{"convert true", hero + "&convert=true", chrome, http.StatusOK, "/insecure/rs:fit:1600:0" + heroSource},
+		{"requested format wins", hero + "&format=png", chrome, http.StatusOK, "/insecure/rs:fit:1600:0/ar:1/f:png/plain/https://images.example.com/landing/hero-dusk.webp"},
+		{"gif keeps its format", sticker, chrome, http.StatusOK, "/insecure/ar:1/plain/https://images.example.com/chat/stickers/party.gif"},
+		{"svg keeps its format", icon, chrome, http.StatusOK, "/insecure/rs:fit:32:32/ar:1/plain/https://images.example.com/ui/icons/bell.svg"},
+	})
+	testServe(t, nil, []serveTest{
+		{"off by default", hero, chrome, http.StatusOK, "/insecure/rs:fit:1600:0" + heroSource},
+	})
+}
+
+func TestSkipProcessingFormats(t *testing.T) {
+	skipping := func(config *Config) { config.SkipProcessingFormats = []string{"svg", ".GIF"} }
+	confetti := signedURL(t, testSecret, [][]string{{"f", "promo/confetti.gif"}, {"p", "thumb", "240x"}}, ".gif")
+	still := signedURL(t, testSecret, [][]string{{"f", "promo/confetti.gif"}}, ".gif")
+	badge := signedURL(t, testSecret, [][]string{{"f", "promo/badge.svg"}, {"p", "thumb", "64x64"}}, ".svg")
+	banner := signedURL(t, testSecret, [][]string{{"f", "promo/banner.jpeg"}, {"p", "thumb", "1200x"}}, ".jpeg")
+	avifClient := http.Header{"Accept": {"image/avif,image/webp,*/*"}}
+	testServe(t, skipping, []serveTest{
+		{"resized gif", confetti, nil, http.StatusOK, "/insecure/rs:fit:240:0/ar:1/skp:svg:gif/f:gif/plain/https://images.example.com/promo/confetti.gif"},
+		// without a forced f:gif imgproxy could convert it and process it after all
+		{"gif keeps its format", still, avifClient, http.StatusOK, "/insecure/ar:1/skp:svg:gif/f:gif/plain/https://images.example.com/promo/confetti.gif"},
+		{"svg", badge, nil, http.StatusOK, "/insecure/rs:fit:64:64/ar:1/skp:svg:gif/plain/https://images.example.com/promo/badge.svg"},
+		{"processed format", banner, avifClient, http.StatusOK, "/insecure/rs:fit:1200:0/ar:1/skp:svg:gif/plain/https://images.example.com/promo/banner.jpeg"},
+		{"requested format", still + "&format=webp", nil, http.StatusOK, "/insecure/ar:1/skp:svg:gif/f:webp/plain/https://images.example.com/promo/confetti.gif"},
+	})
+	testServe(t, func(config *Config) { config.SkipProcessingFormats = []string{"jpg"} }, []serveTest{
+		{"jpeg extension", banner, nil, http.StatusOK, "/insecure/rs:fit:1200:0/ar:1/skp:jpg/f:jpg/plain/https://images.example.com/promo/banner.jpeg"},
+	})
+
+	config := testConfig()
+	config.SkipProcessingFormats = []string{"Svg", "pdf"}
+	if _, err := New(context.Background(), &nextHandler{}, config, "test"); err == nil {
+		t.Error("SkipProcessingFormats pdf accepted")
+	}
+	if !reflect.DeepEqual(config.SkipProcessingFormats, []string{"Svg", "pdf"}) {
+		t.Errorf("New changed the caller's SkipProcessingFormats to %q", config.SkipProcessingFormats)
+	}
+}
+
+func TestJobsShape(t *testing.T) {
+	// jobs are signed by their elements, whatever shape they were sent in
+	sha := CalculateSHA(testSecret, [][]string{{"f", "wiki/diagrams/flow.png"}})
+	payload := func(jobsJSON string) string {
+		return "/media/" + base64.RawURLEncoding.EncodeToString([]byte(jobsJSON)) + ".png?sha=" + sha
+	}
+	const shapeError = "Jobs must be an array of arrays of strings.\n"
+	for _, c := range []struct {
+		name, jobsJSON string
+		status         int
+		body           string
+	}{
+		{"single job", `["f","wiki/diagrams/flow.png"]`, http.StatusOK, ""},
+		{"object", `{"f":"wiki/diagrams/flow.png"}`, http.StatusBadRequest, shapeError},
+		{"job objects", `[{"f":"wiki/diagrams/flow.png"}]`, http.StatusBadRequest, shapeError},
+		{"numbers", `[["f",42]]`, http.StatusBadRequest, shapeError},
+		{"string", `"wiki/diagrams/flow.png"`, http.StatusBadRequest, shapeError},
+		{"null job", `[null]`, http.StatusBadRequest, "Jobs must have a type and an argument.\n"},
+	} {
+		handler, next := newTestHandler(t, func(config *Config) { config.AllowSingleJobShape = true })
+		rw := serve(handler, payload(c.jobsJSON), nil)
+		if rw.Code != c.status || (len(c.body) > 0 && rw.Body.String() != c.body) {
+			t.Errorf("%s: status %d, body %q, want %d %q", c.name, rw.Code, rw.Body.String(), c.status, c.body)
+		}
+		if c.status == http.StatusOK && next.req.URL.Path != "/insecure/ar:1/plain/https://images.example.com/wiki/diagrams/flow.png" {
+			t.Errorf("%s: forwarded %s", c.name, next.req.URL.Path)
+		}
+	}
+}
+
+func TestClientHintDPR(t *testing.T) {
+	jobs := [][]string{{"f", "team/headshots/ops-lead.png"}, {"p", "thumb", "160x160#"}}
+	target := signedURL(t, testSecret, jobs, ".png")
+	forwarded := func(dpr string) string {
+		return "/insecure/rs:fill:160:160:g:ce/ar:1/" + dpr + "plain/https://images.example.com/team/headshots/ops-lead.png"
+	}
+	hint := func(value string) http.Header { return http.Header{"Sec-Ch-Dpr": {value}} }
+
+	handler, next := newTestHandler(t, func(config *Config) { config.UseClientHints = true })
+	check := func(label string, target string, header http.Header, want string) {
+		t.Helper()
+		next.called = false
+		rw := serve(handler, target, header)
+		if want == "" {
+			if rw.Code != http.StatusBadRequest || next.called {
+				t.Errorf("%s: status %d, want 400", label, rw.Code)
+			}
+			return
+		}
+		if rw.Code != http.StatusOK || next.req.URL.Path != want {
+			t.Errorf("%s: status %d, forwarded %s, want %s", label, rw.Code, next.req.URL.Path, want)
+		}
+	}
+	check("no hint", target, nil, forwarded(""))
+	check("hint", target, hint("2"), forwarded("dpr:2/"))
+	check("fractional hint", target, hint("1.50"), forwarded("dpr:1.5/"))
+	check("query only", target+"&dpr=3", nil, forwarded("dpr:3/"))
+	check("hint over query", target+"&dpr=3", hint("1.25"), forwarded("dpr:1.25/"))
+	check("invalid hint", target+"&dpr=3", hint("retina"), "")
+	check("zero hint", target, hint("0"), "")
+	check("hint over the cap", target, hint("9"), "")
+
+	// without UseClientHints only the query parameter counts
+	handler, next = newTestHandler(t, nil)
+	check("ignored hint", target, hint("2"), forwarded(""))
+	check("ignored hint, query", target+"&dpr=2", hint("retina"), forwarded("dpr:2/"))
+
+	// unresized images have no dpr to apply
+	handler, next = newTestHandler(t, func(config *Config) { config.UseClientHints = true })
+	original := signedURL(t, testSecret, jobs[:1], ".png")
+	check("original", original, hint("2"), "/insecure/ar:1/plain/https://images.example.com/team/headshots/ops-lead.png")
+}
+
+func TestMaxDimensionsTimesDPR(t *testing.T) {
+	config := testConfig()
+	config.MaxWidth = 800
+	config.MaxHeight = 600
+	banner := []string{"f", "events/summit/banner.jpg"}
+	for _, c := range []struct {
+		jobs [][]string
+		dpr  float64
+		ok   bool
+	}{
+		{[][]string{banner, {"p", "thumb", "400x"}}, 2, true},
+		{[][]string{banner, {"p", "thumb", "401x"}}, 2, false},
+		{[][]string{banner, {"p", "thumb", "800x"}}, 0, true},
+		{[][]string{banner, {"p", "thumb", "x300"}}, 2.5, false},
+		{[][]string{banner, {"p", "thumb", "200x150"}, {"p", "zoom", "2"}}, 2, true},
+		{[][]string{banner, {"p", "thumb", "200x150"}, {"p", "zoom", "2"}}, 3, false},
+		{[][]string{banner, {"p", "thumb", "200x150"}, {"p", "zoom", "1", "2.5"}}, 1.5, true},
+		{[][]string{banner, {"p", "thumb", "200x150"}, {"p", "zoom", "1", "2.5"}}, 2, false},
+	} {
+		_, err := generate_imgproxy_url(config, c.jobs, requestOptions{dpr: c.dpr})
+		if (err == nil) != c.ok {
+			t.Errorf("%v at dpr %g: error %v", c.jobs[1:], c.dpr, err)
+		}
+	}
+}
+
+func TestPassOriginalWhenNoProcessing(t *testing.T) {
+	podcast := [][]string{{"f", "podcasts/episode-88/cover art.png"}}
+	handler, next := newTestHandler(t, func(config *Config) {
+		config.PassOriginalWhenNoProcessing = true
+		config.StripMetadata = true
+		config.JpegQuality = 80
+	})
+	testServe(t, func(config *Config) {
+		config.PassOriginalWhenNoProcessing = true
+		config.StripMetadata = true
+	}, []serveTest{
+		{name: "fetch only", target: signedURL(t, testSecret, podcast, ".png"), status: http.StatusOK, want: "/insecure/raw:1/plain/https://images.example.com/podcasts/episode-88/cover%20art.png"},
+		{name: "format", target: signedURL(t, testSecret, podcast, ".png") + "&format=webp", status: http.StatusOK, want: "/insecure/sm:1/ar:1/f:webp/plain/https://images.example.com/podcasts/episode-88/cover%20art.png"},
+		{name: "maxbytes", target: signedURL(t, testSecret, podcast, ".png") + "&maxbytes=20000", status: http.StatusOK, want: "/insecure/sm:1/ar:1/mb:20000/plain/https://images.example.com/podcasts/episode-88/cover%20art.png"},
+		{name: "trimmed", target: signedURL(t, testSecret, append(podcast[:1:1], []string{"p", "trim", "6"}), ".png"), status: http.StatusOK, want: "/insecure/trim:6/sm:1/ar:1/plain/https://images.example.com/podcasts/episode-88/cover%20art.png"},
+		{name: "resized", target: signedURL(t, testSecret, append(podcast[:1:1], []string{"p", "thumb", "300x300"}), ".png"), status: http.StatusOK, want: "/insecure/rs:fit:300:300/sm:1/ar:1/plain/https://images.example.com/podcasts/episode-88/cover%20art.png"},
+	})
+
+	// global output options don't count as processing
+	if rw := serve(handler, signedURL(t, testSecret, podcast, ".png"), nil); rw.Code != http.StatusOK || next.req.URL.Path != "/insecure/raw:1/plain/https://images.example.com/podcasts/episode-88/cover art.png" {
+		t.Errorf("status %d, forwarded %s", rw.Code, next.req.URL.Path)
+	}
+
+	config := testConfig()
+	config.SourceURLMode = "base64"
+	config.PassOriginalWhenNoProcessing = true
+	got, err := generate_imgproxy_url(config.normalize(), podcast, requestOptions{})
+	if want := "/insecure/raw:1/" + base64.RawURLEncoding.EncodeToString([]byte("https://images.example.com/podcasts/episode-88/cover%20art.png")) + ".png"; got != want || err != nil {
+		t.Errorf("base64 source %s, %v, want %s", got, err, want)
+	}
+	config.PassOriginalWhenNoProcessing = false
+	if got, _ := generate_imgproxy_url(config.normalize(), podcast, requestOptions{}); strings.Contains(got, "raw:1") {
+		t.Errorf("raw mode without PassOriginalWhenNoProcessing: %s", got)
+	}
+}
+
+func TestOperationOrder(t *testing.T) {
+	source := []string{"f", "archive/scans/letter-1897.png"}
+	steps := map[string][]string{
+		"rot":  {"p", "rotate", "270"},
+		"c":    {"p", "crop", "900x1200+40+60"},
+		"rs":   {"p", "thumb", "450x"},
+		"pix":  {"p", "pixelate", "4"},
+		"trim": {"p", "trim", "20"},
+	}
+	options := map[string]string{
+		"rot":  "rot:270",
+		"c":    "c:900:1200:nowe:40:60",
+		"rs":   "rs:fit:450:0",
+		"pix":  "pix:4",
+		"trim": "trim:20",
+	}
+	// every order of the same steps gives its own url, trim leading them all
+	seen := map[string]string{}
+	for _, order := range [][]string{
+		{"rot", "c", "rs"},
+		{"c", "rot", "rs"},
+		{"rs", "c", "rot"},
+		{"pix", "rs", "trim", "rot"},
+		{"rs", "pix", "rot", "trim"},
+	} {
+		jobs := [][]string{source}
+		want := "/insecure/"
+		if containsString(order, "trim") {
+			want += options["trim"] + "/"
+		}
+		for _, step := range order {
+			jobs = append(jobs, steps[step])
+			if step != "trim" {
+				want += options[step] + "/"
+			}
+		}
+		want += "ar:1/plain/https://images.example.com/archive/scans/letter-1897.png"
+		got, err := generate_imgproxy_url(testConfig(), jobs, requestOptions{})
+		if err != nil || got != want {
+			t.Errorf("order %v: got %s, %v, want %s", order, got, err, want)
+		}
+		if other, ok := seen[got]; ok {
+			t.Errorf("orders %v and %s share %s", order, other, got)
+		}
+		seen[got] = strings.Join(order, ",")
+	}
+}
+
+func TestPathPrefix(t *testing.T) {
+	jobs := [][]string{{"f", "uploads/avatars/u-5521.jpg"}, {"p", "thumb", "96x96#"}}
+	mediaURL := signedURL(t, testSecret, jobs, ".jpg")
+	assetsURL := "/assets/" + strings.TrimPrefix(mediaURL, "/media/")
+	const forwarded = "/insecure/rs:fill:96:96:g:ce/ar:1/plain/https://images.example.com/uploads/avatars/u-5521.jpg"
+
+	// every spelling of the prefix serves /assets/ urls only
+	for _, pathPrefix := range []string{"/assets/", "assets", "/assets", "assets/"} {
+		handler, next := newTestHandler(t, func(config *Config) { config.PathPrefix = pathPrefix })
+		if rw := serve(handler, assetsURL, nil); rw.Code != http.StatusOK || next.req.URL.Path != forwarded {
+			t.Errorf("PathPrefix %q: status %d for %s", pathPrefix, rw.Code, assetsURL)
+		}
+		if rw := serve(handler, mediaURL, nil); rw.Code != http.StatusBadRequest {
+			t.Errorf("PathPrefix %q: status %d for %s, want 400", pathPrefix, rw.Code, mediaURL)
+		}
+	}
+
+	// regex metacharacters in the prefix are literal
+	handler, _ := newTestHandler(t, func(config *Config) { config.PathPrefix = "/cdn.v2/" })
+	if rw := serve(handler, "/cdn.v2/"+strings.TrimPrefix(mediaURL, "/media/"), nil); rw.Code != http.StatusOK {
+		t.Errorf("/cdn.v2/: status %d", rw.Code)
+	}
+	if rw := serve(handler, "/cdnxv2/"+strings.TrimPrefix(mediaURL, "/media/"), nil); rw.Code == http.StatusOK {
+		t.Error("/cdnxv2/ matched PathPrefix /cdn.v2/")
+	}
+
+	// the client builds urls under the same prefix, with the sha in the path too
+	config := testConfig()
+	config.PathPrefix = "assets"
+	if got, err := config.GenerateDragonflyURL(jobs, "jpg"); err != nil || got != assetsURL {
+		t.Errorf("GenerateDragonflyURL: %s, %v, want %s", got, err, assetsURL)
+	}
+	config.ShaInPath = true
+	srcset, err := config.BuildSrcset("https://www.example.com", jobs[:1], []int{200})
+	if err != nil || !strings.HasPrefix(srcset, "https://www.example.com/assets/") || !strings.HasSuffix(srcset, ".jpg 200w") {
+		t.Errorf("BuildSrcset: %q, %v", srcset, err)
+	}
+	handler, next := newTestHandler(t, func(config *Config) {
+		config.PathPrefix = "/assets/"
+		config.ShaInPath = true
+	})
+	if rw := serve(handler, strings.TrimSuffix(strings.TrimPrefix(srcset, "https://www.example.com"), " 200w"), nil); rw.Code != http.StatusOK || !next.called {
+		t.Errorf("srcset url: status %d, body %q", rw.Code, rw.Body.String())
+	}
+}
+
+func TestRequestIDHeader(t *testing.T) {
+	target := signedURL(t, testSecret, [][]string{{"f", "kb/articles/setup-wizard.png"}, {"p", "thumb", "720x"}}, ".png")
+	handler, next := newTestHandler(t, func(config *Config) { config.RequestIDHeader = "X-Request-ID" })
+
+	// every line of the request carries the incoming id
+	output := captureLog(func() {
+		serve(handler, target+"&convert=false", http.Header{"X-Request-Id": {"req-7f3a91"}})
+	})
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) < 2 {
+		t.Fatalf("log %q, want the generated url and convert lines", output)
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, "request_id=req-7f3a91 ") {
+			t.Errorf("line %q without the request id", line)
+		}
+	}
+	if got := next.req.Header.Get("X-Request-ID"); got != "req-7f3a91" {
+		t.Errorf("forwarded X-Request-ID %q", got)
+	}
+
+	// rejections are logged with it too, and a missing id is generated and forwarded
+	output = captureLog(func() { serve(handler, withSHA(target, "feedface"), nil) })
+	generated := regexp.MustCompile(`request_id=([0-9a-f]{16}) SHA validate failed`).FindStringSubmatch(output)
+	if generated == nil {
+		t.Fatalf("log %q, want a generated request id", output)
+	}
+	captureLog(func() { serve(handler, target, nil) })
+	if id := next.req.Header.Get("X-Request-ID"); len(id) != 16 || id == generated[1] {
+		t.Errorf("forwarded X-Request-ID %q, want a new generated id", id)
+	}
+
+	// off by default, lines are left as they were
+	plain, next := newTestHandler(t, nil)
+	if output := captureLog(func() { serve(plain, target, nil) }); strings.Contains(output, "request_id=") || len(next.req.Header.Get("X-Request-ID")) > 0 {
+		t.Errorf("log %q with RequestIDHeader unset", output)
+	}
+}
+
+func TestPercentEncodedPath(t *testing.T) {
+	jobs := [][]string{{"f", "presse/~~~???-0.jpg"}, {"p", "thumb", "300x200"}}
+	payload, err := json.Marshal(jobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// standard base64 of these jobs uses every character proxies escape
+	standard := base64.StdEncoding.EncodeToString(payload)
+	if !strings.Contains(standard, "+") || !strings.Contains(standard, "/") || !strings.HasSuffix(standard, "=") {
+		t.Fatalf("%s lacks + / or =", standard)
+	}
+	escape := strings.NewReplacer("+", "%2B", "/", "%2F", "=", "%3D")
+	query := ".jpg?sha=" + CalculateSHA(testSecret, jobs)
+	const forwarded = "/insecure/rs:fit:300:200/ar:1/plain/https://images.example.com/presse/~~~%3F%3F%3F-0.jpg"
+
+	handler, next := newTestHandler(t, nil)
+	for name, segment := range map[string]string{
+		"url-safe":        base64.RawURLEncoding.EncodeToString(payload),
+		"standard":        standard,
+		"encoded once":    escape.Replace(standard),
+		"encoded twice":   strings.ReplaceAll(escape.Replace(standard), "%", "%25"),
+		"padding escaped": strings.TrimSuffix(standard, "=") + "%253D",
+	} {
+		next.called = false
+		rw := serve(handler, "/media/"+segment+query, nil)
+		if rw.Code != http.StatusOK || !next.called || next.req.URL.EscapedPath() != forwarded {
+			t.Errorf("%s: status %d, body %q", name, rw.Code, rw.Body.String())
+		}
+	}
+
+	// escapes left after unescaping twice are not base64
+	if rw := serve(handler, "/media/"+standard[:8]+"%25zz"+query, nil); rw.Code != http.StatusBadRequest || !strings.Contains(rw.Body.String(), "illegal base64") {
+		t.Errorf("invalid escape: status %d, body %q", rw.Code, rw.Body.String())
+	}
+}
+
+func TestPackedThumbJob(t *testing.T) {
+	menu := []string{"f", "restaurants/88/menu-board.jpg"}
+	packed := [][]string{menu, {"p", "thumb", "400x300#", "crop", "100x100+0+0", "rotate", "90"}}
+	separate := [][]string{menu, {"p", "thumb", "400x300#"}, {"p", "crop", "100x100+0+0"}, {"p", "rotate", "90"}}
+	const forwarded = "/insecure/rs:fill:400:300:g:ce/c:100:100:nowe:0:0/rot:90/ar:1/plain/https://images.example.com/restaurants/88/menu-board.jpg"
+
+	// both forms give the same imgproxy url, each under its own signature
+	handler, next := newTestHandler(t, nil)
+	for name, jobs := range map[string][][]string{"packed": packed, "separate": separate} {
+		if rw := serve(handler, signedURL(t, testSecret, jobs, ".jpg"), nil); rw.Code != http.StatusOK || next.req.URL.Path != forwarded {
+			t.Errorf("%s: status %d, forwarded %s", name, rw.Code, next.req.URL.Path)
+		}
+	}
+	if CalculateSHA(testSecret, packed) == CalculateSHA(testSecret, separate) {
+		t.Error("packed and separate jobs share a signature")
+	}
+
+	// every packed argument is signed, plain concatenation of the elements
+	if got, want := string(jobsMessage(packed)), "frestaurants/88/menu-board.jpgpthumb400x300#crop100x100+0+0rotate90"; got != want {
+		t.Errorf("message %q, want %q", got, want)
+	}
+	for i := 2; i < len(packed[1]); i++ {
+		tampered := [][]string{menu, append([]string{}, packed[1]...)}
+		tampered[1][i] += "0"
+		target := withSHA(signedURL(t, testSecret, tampered, ".jpg"), CalculateSHA(testSecret, packed))
+		if rw := serve(handler, target, nil); rw.Code != http.StatusForbidden {
+			t.Errorf("changed argument %d (%q): status %d, want 403", i, tampered[1][i], rw.Code)
+		}
+	}
+
+	for _, job := range [][]string{
+		{"p", "thumb", "400x300#", "crop"},
+		{"p", "thumb", "400x300#", "crop", "100x100+0+0", "rotate"},
+		{"p", "thumb", "400x300#", "encode", "webp"},
+		{"p", "thumb", "400x300#", "thumb", "200x"},
+		{"p", "thumb", "400x300#", "rotate", "45"},
+	} {
+		if rw := serve(handler, signedURL(t, testSecret, [][]string{menu, job}, ".jpg"), nil); rw.Code != http.StatusBadRequest {
+			t.Errorf("%q: status %d, want 400", job, rw.Code)
+		}
+	}
+}
+
+func TestImgproxySignature(t *testing.T) {
+	// imgproxy's documented example key and salt, signatures from a plain
+	// HMAC-SHA256 of salt and path outside Go
+	const (
+		key  = "943b421c9eb07c830af81030552c86009268de4e532ba2ee2eab8247c6da0881"
+		salt = "520f986b998545b4785e0defbc4f3c1203f22de2374a3d53cb7a7fe9fea309c5"
+	)
+	signed := func(config *Config) {
+		config.ImgproxyKey = key
+		config.ImgproxySalt = salt
+		config.Gravity = "sm"
+	}
+	hall := []string{"f", "museum/halls/east-wing.jpg"}
+	testServe(t, signed, []serveTest{
+		{name: "resized", target: signedURL(t, testSecret, [][]string{hall, {"p", "thumb", "300x400#"}}, ".jpg"), status: http.StatusOK,
+			want: "/pkSEhNYPsE6sIZRZx3bD_MiEs5gPAQzeb-oloiJrJDs/rs:fill:300:400:g:sm/ar:1/plain/https://images.example.com/museum/halls/east-wing.jpg"},
+	})
+	testServe(t, func(config *Config) {
+		signed(config)
+		config.PassOriginalWhenNoProcessing = true
+	}, []serveTest{
+		{name: "raw", target: signedURL(t, testSecret, [][]string{hall}, ".jpg"), status: http.StatusOK,
+			want: "/f0fDSLsw7_iRCWm0pzsEEjlTdLbFPBbE7_2zdXZIUiU/raw:1/plain/https://images.example.com/museum/halls/east-wing.jpg"},
+	})
+
+	// GenerateBatch signs like the handler
+	config := testConfig()
+	signed(config)
+	batch, err := config.GenerateBatch([][][]string{{hall, {"p", "thumb", "300x400#"}}, {hall}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "/pkSEhNYPsE6sIZRZx3bD_MiEs5gPAQzeb-oloiJrJDs/rs:fill:300:400:g:sm/ar:1/plain/https://images.example.com/museum/halls/east-wing.jpg"; batch[0] != want {
+		t.Errorf("batch url %s, want %s", batch[0], want)
+	}
+	if strings.HasPrefix(batch[1], "/insecure") || len(strings.Split(batch[1], "/")[1]) != 43 {
+		t.Errorf("batch url %s, want a signature", batch[1])
+	}
+
+	// bad keys fail at startup, not per request
+	for _, c := range []struct{ key, salt string }{{key, ""}, {"", salt}, {"94zz", salt}, {key, "52 0f"}, {key[:3], salt}} {
+		config := testConfig()
+		config.ImgproxyKey, config.ImgproxySalt = c.key, c.salt
+		if _, err := New(context.Background(), &nextHandler{}, config, "test"); err == nil {
+			t.Errorf("key %q, salt %q accepted", c.key, c.salt)
+		}
+		if _, err := config.GenerateBatch([][][]string{{hall}}); err == nil {
+			t.Errorf("batch with key %q, salt %q generated", c.key, c.salt)
+		}
+	}
+}
+
+func TestImageOnly(t *testing.T) {
+	handler, next := newTestHandler(t, func(config *Config) {
+		config.ImageOnly = true
+		config.Prefixes = map[string]string{"docs": "https://docs.example.com/"}
+	})
+	accepted := map[string][]string{
+		"jpg":               {"f", "handbook/figures/org-chart.jpg"},
+		"upper case":        {"f", "handbook/figures/ORG-CHART.JPEG"},
+		"heic":              {"f", "phone-uploads/IMG_0042.heic"},
+		"absolute, queried": {"f", "https://cdn.example.org/maps/site.webp?version=4"},
+		"data image":        {"f", "data:image/png;base64,iVBORw0KGgo="},
+		"prefix key":        {"f", "docs", "diagrams/network.svg"},
+	}
+	rejected := map[string][]string{
+		"pdf":             {"f", "handbook/policies/leave.pdf"},
+		"zip":             {"f", "handbook/exports/all-figures.zip"},
+		"no extension":    {"f", "handbook/figures/org-chart"},
+		"image in query":  {"f", "https://cdn.example.org/download?file=site.png"},
+		"data text":       {"f", "data:text/html;base64,PGI+aGk8L2I+"},
+		"prefix key, pdf": {"f", "docs", "manuals/setup.pdf"},
+	}
+	for name, fetch := range accepted {
+		next.called = false
+		if rw := serve(handler, signedURL(t, testSecret, [][]string{fetch, {"p", "thumb", "250x"}}, ""), nil); rw.Code != http.StatusOK || !next.called {
+			t.Errorf("%s: status %d, body %q", name, rw.Code, rw.Body.String())
+		}
+	}
+	for name, fetch := range rejected {
+		next.called = false
+		rw := serve(handler, signedURL(t, testSecret, [][]string{fetch, {"p", "thumb", "250x"}}, ""), nil)
+		if rw.Code != http.StatusBadRequest || next.called || rw.Body.String() != "Fetch path is not an image.\n" {
+			t.Errorf("%s: status %d, body %q, want 400", name, rw.Code, rw.Body.String())
+		}
+	}
+
+	// the signature is checked first, and the check is off by default
+	pdf := signedURL(t, testSecret, [][]string{rejected["pdf"]}, "")
+	if rw := serve(handler, withSHA(pdf, "00ff00ff00ff00ff"), nil); rw.Code != http.StatusForbidden {
+		t.Errorf("forged pdf url: status %d, want 403", rw.Code)
+	}
+	permissive, _ := newTestHandler(t, nil)
+	if rw := serve(permissive, pdf, nil); rw.Code != http.StatusOK {
+		t.Errorf("pdf without ImageOnly: status %d", rw.Code)
+	}
+}
+
+func TestFractionalCrop(t *testing.T) {
+	satellite := []string{"f", "satellite/tiles/delta-region.png"}
+	crop := func(geometry string) (string, error) {
+		imgproxy_url, err := generate_imgproxy_url(testConfig(), [][]string{satellite, {"p", "crop", geometry}}, requestOptions{})
+		return strings.TrimSuffix(strings.TrimPrefix(imgproxy_url, "/insecure/"), "/ar:1/plain/https://images.example.com/satellite/tiles/delta-region.png"), err
+	}
+	for geometry, want := range map[string]string{
+		"0.5x0.5+0.25+0.25":   "c:0.5:0.5:nowe:0.25:0.25",
+		"0.5x0.5":             "c:0.5:0.5",
+		"0.750x0.40+0.1+0.00": "c:0.75:0.4:nowe:0.1:0",
+		"0.5x300+0.25+40":     "c:0.5:300:nowe:0.25:40",
+		"640x480+12+8":        "c:640:480:nowe:12:8",
+	} {
+		if got, err := crop(geometry); err != nil || got != want {
+			t.Errorf("crop %s: got %s, %v, want %s", geometry, got, err, want)
+		}
+	}
+	for _, geometry := range []string{"1.0x0.5", "0.5x1.5", "0.5x0.5+1.25+0", ".5x.5", "0.5x0.5+0.25", "0,5x0,5", "0.5.1x0.5"} {
+		if got, err := crop(geometry); err == nil {
+			t.Errorf("crop %s accepted as %s", geometry, got)
+		}
+	}
+
+	// fractions are signed as written, 0.50 and 0.5 are different urls
+	handler, next := newTestHandler(t, nil)
+	jobs := [][]string{satellite, {"p", "crop", "0.50x0.5"}}
+	if rw := serve(handler, signedURL(t, testSecret, jobs, ".png"), nil); rw.Code != http.StatusOK || !strings.Contains(next.req.URL.Path, "/c:0.5:0.5/") {
+		t.Errorf("status %d, forwarded %s", rw.Code, next.req.URL.Path)
+	}
+	forged := withSHA(signedURL(t, testSecret, [][]string{satellite, {"p", "crop", "0.5x0.5"}}, ".png"), CalculateSHA(testSecret, jobs))
+	if rw := serve(handler, forged, nil); rw.Code != http.StatusForbidden {
+		t.Errorf("respelled fraction: status %d, want 403", rw.Code)
+	}
+}
+
+func TestDefaultResize(t *testing.T) {
+	poster := []string{"f", "festival/2026/poster-final.png"}
+	original := signedURL(t, testSecret, [][]string{poster}, ".png")
+	rotated := signedURL(t, testSecret, [][]string{poster, {"p", "rotate", "180"}}, ".png")
+	const source = "/ar:1/plain/https://images.example.com/festival/2026/poster-final.png"
+
+	capped := func(config *Config) {
+		config.DefaultResize = "2000x2000>"
+		config.MaxWidth = 3000
+	}
+	testServe(t, capped, []serveTest{
+		{name: "fetch only", target: original, status: http.StatusOK, want: "/insecure/rs:fit:2000:2000:0" + source},
+		{name: "with a process job", target: rotated, status: http.StatusOK, want: "/insecure/rot:180" + source},
+		{name: "at dpr 2 over MaxWidth", target: original + "&dpr=2", status: http.StatusBadRequest},
+	})
+	testServe(t, nil, []serveTest{
+		{name: "no default", target: original, status: http.StatusOK, want: "/insecure" + source},
+	})
+	testServe(t, func(config *Config) { config.DefaultResize = "1200x630#+0+40" }, []serveTest{
+		{name: "fill with offsets", target: original, status: http.StatusOK, want: "/insecure/rs:fill:1200:630/g:ce:0:40" + source},
+	})
+
+	// the same geometry checks as thumb jobs, at startup
+	for _, geometry := range []string{"large", "x", "0x600", "70000x", "2000x2000>+10+10", "4000x"} {
+		config := testConfig()
+		config.DefaultResize = geometry
+		config.MaxWidth = 3000
+		if _, err := New(context.Background(), &nextHandler{}, config, "test"); err == nil || !strings.Contains(err.Error(), "DefaultResize") {
+			t.Errorf("DefaultResize %q: error %v", geometry, err)
+		}
+	}
+}
+
+func TestDeterministicOutput(t *testing.T) {
+	// every pattern matches, the first one in sorted order picks the format
+	overlapping := func(config *Config) {
+		config.FormatByPathRegex = map[string]string{`^/media/`: "avif", `\.jpg$`: "webp", `pasta`: "png", `.`: "jpg"}
+		config.Prefixes = map[string]string{"eu": "https://eu.example.com/", "us": "https://us.example.com/", "ap": "https://ap.example.com/"}
+	}
+	target := signedURL(t, testSecret, [][]string{{"f", "menu/pasta.jpg"}, {"p", "thumb", "640x480#"}, {"p", "rotate", "90"}}, ".jpg")
+	urls := map[string]int{}
+	for i := 0; i < 50; i++ {
+		handler, next := newTestHandler(t, overlapping)
+		if rec := serve(handler, target, nil); rec.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+		}
+		urls[next.req.URL.EscapedPath()]++
+	}
+	if len(urls) != 1 {
+		t.Errorf("urls differ between runs: %v", urls)
+	}
+	for path := range urls {
+		if !strings.Contains(path, "/f:jpg/") { // "." sorts first
+			t.Errorf("format not from the first sorted pattern: %s", path)
+		}
+	}
+
+	// with several invalid entries the error always names the first key
+	messages := map[string]int{}
+	for i := 0; i < 50; i++ {
+		config := testConfig()
+		config.Secrets = map[string]string{"zeta": "", "alpha": "", "mid": ""}
+		config.Prefixes = map[string]string{"b": "ftp://b.example.com/", "a": "ftp://a.example.com/"}
+		if _, err := New(context.Background(), &nextHandler{}, config, "test"); err != nil {
+			messages[err.Error()]++
+		}
+	}
+	if len(messages) != 1 {
+		t.Fatalf("errors differ between runs: %v", messages)
+	}
+	for message := range messages {
+		if !strings.Contains(message, `"alpha"`) {
+			t.Errorf("error does not name the first tenant: %s", message)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package dragonfly2imgproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// upper bounds in seconds of the url generation latency buckets
+var latencyBuckets = []float64{0.00001, 0.000025, 0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005}
+
+// request failures counted apart from their response status
+const (
+	failureSha    = "sha"
+	failureBase64 = "base64"
+	failureJSON   = "json"
+)
+
+// Metrics is a snapshot of the middleware counters, see Collector.
+type Metrics struct {
+	Requests uint64
+	// requests by response status code
+	Responses    map[int]uint64
+	ShaFailures  uint64
+	Base64Errors uint64
+	JSONErrors   uint64
+	// imgproxy url generation latency
+	GenerateLatency Histogram
+}
+
+// Histogram counts observations in seconds into cumulative buckets.
+type Histogram struct {
+	Buckets []float64 // upper bounds
+	Counts  []uint64  // observations <= the matching upper bound
+	Count   uint64
+	Sum     float64
+}
+
+// metrics is nil when EnableMetrics is off, all methods are then no-ops
+type metrics struct {
+	mu       sync.Mutex
+	snapshot Metrics
+}
+
+func newMetrics() *metrics {
+	return &metrics{snapshot: Metrics{
+		Responses: map[int]uint64{},
+		GenerateLatency: Histogram{
+			Buckets: latencyBuckets,
+			Counts:  make([]uint64, len(latencyBuckets)),
+		},
+	}}
+}
+
+func (m *metrics) count(update func(*Metrics)) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	update(&m.snapshot)
+}
+
+// Count a finished request, failure is empty or one of the failure constants
+func (m *metrics) record(status int, failure string) {
+	m.count(func(snapshot *Metrics) {
+		snapshot.Requests++
+		snapshot.Responses[status]++
+		switch failure {
+		case failureSha:
+			snapshot.ShaFailures++
+		case failureBase64:
+			snapshot.Base64Errors++
+		case failureJSON:
+			snapshot.JSONErrors++
+		}
+	})
+}
+
+func (m *metrics) observeGenerate(start time.Time) {
+	seconds := time.Since(start).Seconds()
+	m.count(func(snapshot *Metrics) {
+		latency := &snapshot.GenerateLatency
+		for i, bound := range latency.Buckets {
+			if seconds <= bound {
+				latency.Counts[i]++
+			}
+		}
+		latency.Count++
+		latency.Sum += seconds
+	})
+}
+
+// Collector returns a snapshot of the metrics, zero when EnableMetrics is off.
+func (d *Dragonfly2imgproxy) Collector() Metrics {
+	var snapshot Metrics
+	d.metrics.count(func(current *Metrics) {
+		snapshot = *current
+		snapshot.Responses = make(map[int]uint64, len(current.Responses))
+		for status, count := range current.Responses {
+			snapshot.Responses[status] = count
+		}
+		snapshot.GenerateLatency.Counts = append([]uint64(nil), current.GenerateLatency.Counts...)
+	})
+	return snapshot
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format, so
+// they can be served to a Prometheus scraper without the client library.
+func (m Metrics) WriteTo(w io.Writer) (int64, error) {
+	var b bytes.Buffer
+	counter := func(name string, help string) {
+		fmt.Fprintf(&b, "# HELP dragonfly2imgproxy_%s %s\n# TYPE dragonfly2imgproxy_%s counter\n", name, help, name)
+	}
+	counter("requests_total", "Requests handled by the middleware.")
+	fmt.Fprintf(&b, "dragonfly2imgproxy_requests_total %d\n", m.Requests)
+	counter("responses_total", "Requests by response status code.")
+	codes := make([]int, 0, len(m.Responses))
+	for code := range m.Responses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(&b, "dragonfly2imgproxy_responses_total{code=\"%d\"} %d\n", code, m.Responses[code])
+	}
+	counter("sha_failures_total", "Requests whose sha did not match their jobs.")
+	fmt.Fprintf(&b, "dragonfly2imgproxy_sha_failures_total %d\n", m.ShaFailures)
+	counter("base64_errors_total", "Requests whose jobs were not valid base64.")
+	fmt.Fprintf(&b, "dragonfly2imgproxy_base64_errors_total %d\n", m.Base64Errors)
+	counter("json_errors_total", "Requests whose jobs were not valid JSON.")
+	fmt.Fprintf(&b, "dragonfly2imgproxy_json_errors_total %d\n", m.JSONErrors)
+
+	latency := m.GenerateLatency
+	b.WriteString("# HELP dragonfly2imgproxy_generate_seconds Time spent generating imgproxy urls.\n# TYPE dragonfly2imgproxy_generate_seconds histogram\n")
+	for i, bound := range latency.Buckets {
+		fmt.Fprintf(&b, "dragonfly2imgproxy_generate_seconds_bucket{le=\"%s\"} %d\n", strconv.FormatFloat(bound, 'g', -1, 64), latency.Counts[i])
+	}
+	fmt.Fprintf(&b, "dragonfly2imgproxy_generate_seconds_bucket{le=\"+Inf\"} %d\n", latency.Count)
+	fmt.Fprintf(&b, "dragonfly2imgproxy_generate_seconds_sum %s\n", strconv.FormatFloat(latency.Sum, 'g', -1, 64))
+	fmt.Fprintf(&b, "dragonfly2imgproxy_generate_seconds_count %d\n", latency.Count)
+	return b.WriteTo(w)
+}
+
+// statusRecorder remembers the status written by the handler for metrics
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
@@ -0,0 +1,112 @@
+package dragonfly2imgproxy
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMetricsPerOutcome(t *testing.T) {
+	jobs := [][]string{{"f", "reports/q3-chart.png"}, {"p", "thumb", "800x"}}
+	valid := signedURL(t, testSecret, jobs, ".png")
+	badJSON := "/media/" + base64.RawURLEncoding.EncodeToString([]byte(`[["f",`)) + ".png?sha=0123456789abcdef"
+	single := "/media/" + base64.RawURLEncoding.EncodeToString([]byte(`["f","reports/q3-chart.png"]`)) + ".png?sha=" + CalculateSHA(testSecret, [][]string{{"f", "reports/q3-chart.png"}})
+	badTrim := [][]string{{"f", "reports/q3-chart.png"}, {"p", "trim", "-1"}}
+	tests := []struct {
+		name   string
+		target string
+		status int
+		check  func(Metrics) uint64
+	}{
+		{"forwarded", valid, http.StatusOK, nil},
+		{"not a media url", "/assets/app.js", http.StatusBadRequest, nil},
+		{"missing sha", valid[:strings.Index(valid, "?")], http.StatusBadRequest, nil},
+		{"base64", "/media/not*base64.png?sha=0123456789abcdef", http.StatusBadRequest, func(m Metrics) uint64 { return m.Base64Errors }},
+		{"json", badJSON, http.StatusBadRequest, func(m Metrics) uint64 { return m.JSONErrors }},
+		{"single job", single, http.StatusBadRequest, nil},
+		{"sha mismatch", withSHA(valid, "0123456789abcdef"), http.StatusForbidden, func(m Metrics) uint64 { return m.ShaFailures }},
+		{"invalid job", signedURL(t, testSecret, badTrim, ".png"), http.StatusBadRequest, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler, _ := newTestHandler(t, func(config *Config) { config.EnableMetrics = true })
+			if rw := serve(handler, test.target, nil); rw.Code != test.status {
+				t.Fatalf("status %d, want %d", rw.Code, test.status)
+			}
+			got := handler.(*Dragonfly2imgproxy).Collector()
+			if got.Requests != 1 || got.Responses[test.status] != 1 || len(got.Responses) != 1 {
+				t.Errorf("requests %d, responses %v, want one %d", got.Requests, got.Responses, test.status)
+			}
+			failures := got.ShaFailures + got.Base64Errors + got.JSONErrors
+			if test.check == nil && failures != 0 {
+				t.Errorf("failures counted: %+v", got)
+			}
+			if test.check != nil && (test.check(got) != 1 || failures != 1) {
+				t.Errorf("failure not counted once: %+v", got)
+			}
+		})
+	}
+}
+
+func TestMetricsLatencyAndSnapshots(t *testing.T) {
+	handler, _ := newTestHandler(t, func(config *Config) { config.EnableMetrics = true })
+	d := handler.(*Dragonfly2imgproxy)
+	valid := signedURL(t, testSecret, [][]string{{"f", "reports/q3-chart.png"}}, ".png")
+	serve(handler, valid, nil)
+	serve(handler, valid, nil)
+	serve(handler, withSHA(valid, "0123456789abcdef"), nil) // rejected before generating
+
+	got := d.Collector()
+	latency := got.GenerateLatency
+	if latency.Count != 2 || len(latency.Counts) != len(latency.Buckets) || latency.Counts[len(latency.Counts)-1] > latency.Count {
+		t.Errorf("latency %+v, want 2 observations", latency)
+	}
+	got.Responses[http.StatusOK] = 100
+	got.GenerateLatency.Counts[0] = 100
+	if again := d.Collector(); again.Responses[http.StatusOK] != 2 || again.GenerateLatency.Counts[0] == 100 {
+		t.Errorf("snapshot shares state with the handler: %+v", again)
+	}
+
+	disabled, _ := newTestHandler(t, nil)
+	serve(disabled, valid, nil)
+	if got := disabled.(*Dragonfly2imgproxy).Collector(); got.Requests != 0 || got.GenerateLatency.Count != 0 {
+		t.Errorf("metrics counted while disabled: %+v", got)
+	}
+}
+
+func TestMetricsWriteTo(t *testing.T) {
+	metrics := Metrics{
+		Requests:     5,
+		Responses:    map[int]uint64{500: 1, 200: 3, 400: 1},
+		ShaFailures:  1,
+		Base64Errors: 0,
+		JSONErrors:   0,
+		GenerateLatency: Histogram{
+			Buckets: []float64{0.0001, 0.001},
+			Counts:  []uint64{2, 3},
+			Count:   4,
+			Sum:     0.0125,
+		},
+	}
+	var b strings.Builder
+	if _, err := metrics.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"# TYPE dragonfly2imgproxy_requests_total counter",
+		"dragonfly2imgproxy_requests_total 5",
+		"dragonfly2imgproxy_responses_total{code=\"200\"} 3\ndragonfly2imgproxy_responses_total{code=\"400\"} 1\ndragonfly2imgproxy_responses_total{code=\"500\"} 1",
+		"dragonfly2imgproxy_sha_failures_total 1",
+		"dragonfly2imgproxy_json_errors_total 0",
+		"# TYPE dragonfly2imgproxy_generate_seconds histogram",
+		"dragonfly2imgproxy_generate_seconds_bucket{le=\"0.0001\"} 2",
+		"dragonfly2imgproxy_generate_seconds_bucket{le=\"+Inf\"} 4",
+		"dragonfly2imgproxy_generate_seconds_sum 0.0125",
+		"dragonfly2imgproxy_generate_seconds_count 4",
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("missing %q in\n%s", line, b.String())
+		}
+	}
+}
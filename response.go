@@ -0,0 +1,51 @@
+package dragonfly2imgproxy
+
+import "net/http"
+
+// responseWriter sets extra headers on the image response right before
+// the next handler writes its status.
+type responseWriter struct {
+	http.ResponseWriter
+	headers http.Header
+	// Cache-Control for 2xx responses, kept when next set its own unless
+	// cacheControlOverride
+	cacheControl         string
+	cacheControlOverride bool
+	wroteHeader          bool
+}
+
+func newResponseWriter(rw http.ResponseWriter, headers http.Header) *responseWriter {
+	return &responseWriter{ResponseWriter: rw, headers: headers}
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		for key, values := range w.headers {
+			w.ResponseWriter.Header()[key] = values
+		}
+		if len(w.cacheControl) > 0 && code >= 200 && code < 300 {
+			if w.cacheControlOverride || len(w.ResponseWriter.Header().Get("Cache-Control")) == 0 {
+				w.ResponseWriter.Header().Set("Cache-Control", w.cacheControl)
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush keeps streaming working when the underlying writer supports it.
+func (w *responseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,391 @@
+package dragonfly2imgproxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimingAllowOrigin(t *testing.T) {
+	const origin = "https://shop.example.com"
+	valid := signedURL(t, testSecret, [][]string{{"f", "banners/spring.webp"}}, ".webp")
+
+	handler, next := newTestHandler(t, func(config *Config) { config.TimingAllowOrigin = origin })
+	if rw := serve(handler, valid, nil); rw.Header().Get("Timing-Allow-Origin") != origin {
+		t.Errorf("image response headers %v, want Timing-Allow-Origin %q", rw.Header(), origin)
+	}
+	if !next.called {
+		t.Fatal("next not called")
+	}
+
+	forged := valid[:strings.Index(valid, "?sha=")] + "?sha=ffffffffffffffff"
+	if rw := serve(handler, forged, nil); rw.Header().Get("Timing-Allow-Origin") != "" {
+		t.Errorf("error response got Timing-Allow-Origin %q", rw.Header().Get("Timing-Allow-Origin"))
+	}
+
+	handler, _ = newTestHandler(t, nil)
+	if _, ok := serve(handler, valid, nil).Header()["Timing-Allow-Origin"]; ok {
+		t.Error("Timing-Allow-Origin sent without being configured")
+	}
+}
+
+func TestResponseWriterWriteSetsHeaders(t *testing.T) {
+	rw := serve(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw = newResponseWriter(rw, http.Header{"X-Extra": {"1"}})
+		rw.Write([]byte("image"))
+	}), "/", nil)
+	if rw.Code != http.StatusOK || rw.Header().Get("X-Extra") != "1" {
+		t.Errorf("status %d headers %v, want 200 with X-Extra", rw.Code, rw.Header())
+	}
+}
+
+func TestDebugHeaders(t *testing.T) {
+	jobs := [][]string{{"f", "recipes/ramen/step-2.jpg"}, {"p", "thumb", "640x>"}, {"p", "rotate", "180"}}
+	target := signedURL(t, testSecret, jobs, ".jpg")
+
+	handler, _ := newTestHandler(t, func(config *Config) { config.DebugHeaders = true })
+	header := serve(handler, target, nil).Header().Get("X-Dragonfly-Jobs")
+	var echoed [][]string
+	if err := json.Unmarshal([]byte(header), &echoed); err != nil || !reflect.DeepEqual(echoed, jobs) {
+		t.Errorf("X-Dragonfly-Jobs %q, want %q", header, jobs)
+	}
+	if rw := serve(handler, withSHA(target, "0000000000000000"), nil); rw.Header().Get("X-Dragonfly-Jobs") != "" {
+		t.Error("X-Dragonfly-Jobs sent on a rejected request")
+	}
+
+	for _, configure := range []func(*Config){nil, func(config *Config) { config.DebugHeaders = false }} {
+		handler, _ := newTestHandler(t, configure)
+		if _, ok := serve(handler, target, nil).Header()["X-Dragonfly-Jobs"]; ok {
+			t.Error("X-Dragonfly-Jobs sent without DebugHeaders")
+		}
+	}
+}
+
+func TestRedirectMode(t *testing.T) {
+	jobs := [][]string{{"f", "gallery/autumn walk.jpg"}, {"p", "thumb", "1024x768>"}}
+	target := signedURL(t, testSecret, jobs, ".jpg")
+	handler, next := newTestHandler(t, func(config *Config) {
+		config.RedirectMode = true
+		config.ImgproxyBaseURL = "https://imgproxy.example.org/"
+		config.PassthroughParams = []string{"cachebuster"}
+		config.TimingAllowOrigin = "*"
+	})
+
+	rw := serve(handler, target+"&cachebuster=7&convert=false", nil)
+	const location = "https://imgproxy.example.org/insecure/rs:fit:1024:768:0/ar:1/plain/https://images.example.com/gallery/autumn%20walk.jpg?cachebuster=7"
+	if rw.Code != http.StatusFound || rw.Header().Get("Location") != location {
+		t.Errorf("status %d, Location %q, want 302 to %s", rw.Code, rw.Header().Get("Location"), location)
+	}
+	if rw.Header().Get("Timing-Allow-Origin") != "*" {
+		t.Errorf("redirect headers %v, want Timing-Allow-Origin", rw.Header())
+	}
+	if next.called {
+		t.Error("next called in RedirectMode")
+	}
+	if rw := serve(handler, withSHA(target, "00000000"), nil); rw.Code == http.StatusFound || rw.Header().Get("Location") != "" {
+		t.Errorf("forged sha redirected with status %d", rw.Code)
+	}
+
+	for _, baseURL := range []string{"", "imgproxy.example.org", "/imgproxy"} {
+		config := testConfig()
+		config.RedirectMode = true
+		config.ImgproxyBaseURL = baseURL
+		if _, err := New(context.Background(), &nextHandler{}, config, "test"); err == nil {
+			t.Errorf("RedirectMode accepted ImgproxyBaseURL %q", baseURL)
+		}
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	target := signedURL(t, testSecret, [][]string{{"f", "weather/radar-loop.gif"}, {"p", "thumb", "512x"}}, ".gif")
+	// imgproxy stand-in answering with status and, unless empty, its own Cache-Control
+	upstream := func(status int, cacheControl string) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if len(cacheControl) > 0 {
+				rw.Header().Set("Cache-Control", cacheControl)
+			}
+			rw.WriteHeader(status)
+		})
+	}
+	const long = "public, max-age=31536000, immutable"
+	tests := []struct {
+		name     string
+		override bool
+		next     http.Handler
+		want     string
+	}{
+		{"set when absent", false, upstream(http.StatusOK, ""), long},
+		{"kept from imgproxy", false, upstream(http.StatusOK, "max-age=60"), "max-age=60"},
+		{"overridden", true, upstream(http.StatusOK, "max-age=60"), long},
+		{"partial content", true, upstream(http.StatusPartialContent, ""), long},
+		{"imgproxy error", true, upstream(http.StatusNotFound, "no-store"), "no-store"},
+		{"upstream failure", false, upstream(http.StatusBadGateway, ""), ""},
+	}
+	for _, tt := range tests {
+		config := testConfig()
+		config.CacheControl = long
+		config.CacheControlOverride = tt.override
+		handler, err := New(context.Background(), tt.next, config, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := serve(handler, target, nil).Header().Get("Cache-Control"); got != tt.want {
+			t.Errorf("%s: Cache-Control %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// rejected requests never get the long lived header
+	handler, _ := newTestHandler(t, func(config *Config) { config.CacheControl = long })
+	if rw := serve(handler, withSHA(target, "deadbeef"), nil); rw.Header().Get("Cache-Control") != "" {
+		t.Errorf("rejected request got Cache-Control %q", rw.Header().Get("Cache-Control"))
+	}
+}
+
+func TestErrorFormat(t *testing.T) {
+	jobs := [][]string{{"f", "orders/8841/receipt.png"}, {"p", "thumb", "600x"}}
+	valid := signedURL(t, testSecret, jobs, ".png")
+	encode := func(payload string) string {
+		return "/media/" + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".png?sha=" + CalculateSHA(testSecret, nil)
+	}
+	now := time.Now().Unix()
+	expiring := func(config *Config) { config.ExpirySeconds = 300 }
+	tests := []struct {
+		code      string
+		configure func(*Config)
+		target    string
+		status    int
+	}{
+		{"URL_MISMATCH", nil, "/assets/receipt.png", http.StatusBadRequest},
+		{"MISSING_SHA", nil, valid[:strings.Index(valid, "?")], http.StatusBadRequest},
+		{"JOBS_TOO_LARGE", func(config *Config) { config.MaxJobBytes = 8 }, valid, http.StatusBadRequest},
+		{"INVALID_BASE64", nil, "/media/receipt!!.png?sha=abc", http.StatusBadRequest},
+		{"INVALID_JSON", nil, encode(`[["f", "orders/8841`), http.StatusBadRequest},
+		{"SINGLE_JOB_SHAPE", nil, encode(`["f", "orders/8841/receipt.png"]`), http.StatusBadRequest},
+		{"INVALID_JOBS_SHAPE", nil, encode(`{"f": "orders/8841/receipt.png"}`), http.StatusBadRequest},
+		{"EMPTY_JOBS", nil, encode(`[]`), http.StatusBadRequest},
+		{"INVALID_JOBS", nil, encode(`[["f"]]`), http.StatusBadRequest},
+		{"INVALID_JOBS", nil, signedURL(t, testSecret, [][]string{{"f", "orders/8841/receipt.png"}, {"p", "thumb", "wide"}}, ".png"), http.StatusBadRequest},
+		{"INVALID_EXP", expiring, valid + "&exp=tomorrow", http.StatusBadRequest},
+		{"UNKNOWN_TENANT", nil, valid + "&tenant=acme", http.StatusBadRequest},
+		{"SHA_MISMATCH", nil, withSHA(valid, "0123456789abcdef"), http.StatusForbidden},
+		{"PATH_NOT_ALLOWED", func(config *Config) { config.AllowedPathPrefixes = []string{"invoices/"} }, valid, http.StatusForbidden},
+		{"NOT_AN_IMAGE", func(config *Config) { config.ImageOnly = true }, signedURL(t, testSecret, [][]string{{"f", "orders/8841/receipt.pdf"}}, ""), http.StatusBadRequest},
+		{"URL_EXPIRED", expiring, expiringURL(t, jobs, ".png", strconv.FormatInt(now-1, 10)), http.StatusForbidden},
+		{"EXPIRY_TOO_FAR", expiring, expiringURL(t, jobs, ".png", strconv.FormatInt(now+3600, 10)), http.StatusForbidden},
+		{"INVALID_OPTIONS", nil, valid + "&maxbytes=-1", http.StatusBadRequest},
+		{"URL_TOO_LONG", func(config *Config) { config.MaxURLLength = 20 }, valid, http.StatusRequestURITooLong},
+	}
+	for _, test := range tests {
+		handler, next := newTestHandler(t, func(config *Config) {
+			config.ErrorFormat = "json"
+			if test.configure != nil {
+				test.configure(config)
+			}
+		})
+		rw := serve(handler, test.target, nil)
+		var body errorResponse
+		if err := json.Unmarshal(rw.Body.Bytes(), &body); err != nil {
+			t.Errorf("%s: body %q is not json: %v", test.code, rw.Body.String(), err)
+			continue
+		}
+		if rw.Code != test.status || body.Code != test.code || len(body.Error) == 0 || next.called {
+			t.Errorf("%s: status %d, body %+v, want %d", test.code, rw.Code, body, test.status)
+		}
+		if contentType := rw.Header().Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("%s: Content-Type %q", test.code, contentType)
+		}
+	}
+
+	// no request reaches the unescape failure, the writer still renders it
+	handler, err := NewHandler(context.Background(), &nextHandler{}, &Config{DragonflySecret: testSecret, URLPrefix: testPrefix, ErrorFormat: "json"}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw := httptest.NewRecorder()
+	handler.error(rw, "invalid URL escape", "INTERNAL_ERROR", http.StatusInternalServerError)
+	if rw.Code != http.StatusInternalServerError || rw.Body.String() != `{"error":"invalid URL escape","code":"INTERNAL_ERROR"}`+"\n" {
+		t.Errorf("status %d, body %q", rw.Code, rw.Body.String())
+	}
+
+	// text stays the default, with the same statuses
+	textHandler, _ := newTestHandler(t, nil)
+	if rw := serve(textHandler, withSHA(valid, "0123456789abcdef"), nil); rw.Code != http.StatusForbidden || rw.Body.String() != "SHA validate failed\n" {
+		t.Errorf("text error: status %d, body %q", rw.Code, rw.Body.String())
+	}
+	config := testConfig()
+	config.ErrorFormat = "xml"
+	if _, err := New(context.Background(), &nextHandler{}, config, "test"); err == nil {
+		t.Error("ErrorFormat xml accepted")
+	}
+}
+
+func TestMissingShaStatus(t *testing.T) {
+	signed := signedURL(t, testSecret, [][]string{{"f", "press/kit/logo-dark.svg"}}, ".svg")
+	unsigned := signed[:strings.Index(signed, "?")]
+
+	// zero value configs, as from a bare struct, fall back to 400 too
+	bare, err := NewHandler(context.Background(), &nextHandler{}, &Config{DragonflySecret: testSecret, URLPrefix: testPrefix}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaults, _ := newTestHandler(t, nil)
+	for name, handler := range map[string]http.Handler{"CreateConfig": defaults, "bare Config": bare} {
+		if rw := serve(handler, unsigned, nil); rw.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", name, rw.Code)
+		}
+	}
+
+	hidden, next := newTestHandler(t, func(config *Config) {
+		config.MissingShaStatus = http.StatusNotFound
+		config.ErrorFormat = "json"
+	})
+	rw := serve(hidden, unsigned+"?width=300", nil)
+	if rw.Code != http.StatusNotFound || !strings.Contains(rw.Body.String(), `"code":"MISSING_SHA"`) || next.called {
+		t.Errorf("status %d, body %q, want 404 MISSING_SHA", rw.Code, rw.Body.String())
+	}
+	// only the missing sha is hidden, a wrong one is still forbidden
+	if rw := serve(hidden, withSHA(signed, "abcdef0123456789"), nil); rw.Code != http.StatusForbidden {
+		t.Errorf("wrong sha: status %d, want 403", rw.Code)
+	}
+	if rw := serve(hidden, signed, nil); rw.Code != http.StatusOK || !next.called {
+		t.Errorf("signed url: status %d", rw.Code)
+	}
+
+	for _, status := range []int{http.StatusOK, http.StatusFound, 399, 600, -404} {
+		config := testConfig()
+		config.MissingShaStatus = status
+		if _, err := New(context.Background(), &nextHandler{}, config, "test"); err == nil {
+			t.Errorf("MissingShaStatus %d accepted", status)
+		}
+	}
+}
+
+func TestDownloadFilename(t *testing.T) {
+	jobs := [][]string{{"f", "reports/q3/revenue-chart.png"}, {"p", "thumb", "1600x"}}
+	target := signedURL(t, testSecret, jobs, ".png")
+	handler, next := newTestHandler(t, nil)
+	fn := func(name string) string { return base64.RawURLEncoding.EncodeToString([]byte(name)) }
+
+	for query, filename := range map[string]string{
+		"filename=chart.png":                         "chart.png",
+		"filename=Q3+revenue+%E2%80%94+final%3F.png": "Q3 revenue — final?.png",
+		"filename=..%2F..%2Fetc%2Fchart.png":         "....etcchart.png",
+		"filename=line%0Abreak%5Cchart%3Aq3%25.png":  "linebreakchart:q3%.png",
+		"filename=%22quoted%22%3B+name%3Dx.png":      `"quoted"; name=x.png`,
+	} {
+		rw := serve(handler, target+"&"+query, nil)
+		want := "/insecure/rs:fit:1600:0/ar:1/fn:" + fn(filename) + ":1/plain/https://images.example.com/reports/q3/revenue-chart.png"
+		if rw.Code != http.StatusOK || next.req.URL.EscapedPath() != want {
+			t.Errorf("%s: status %d, forwarded %s, want %s", query, rw.Code, next.req.URL.EscapedPath(), want)
+		}
+		if next.req.URL.Query().Has("filename") {
+			t.Errorf("%s: filename passed through to imgproxy", query)
+		}
+	}
+
+	for _, query := range []string{"filename=%2F%2F", "filename=..", "filename=%0D%0A", "filename=+.+"} {
+		if rw := serve(handler, target+"&"+query, nil); rw.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", query, rw.Code)
+		}
+	}
+
+	// raw mode keeps the download name
+	raw, next := newTestHandler(t, func(config *Config) { config.PassOriginalWhenNoProcessing = true })
+	serve(raw, signedURL(t, testSecret, jobs[:1], ".png")+"&filename=chart.png", nil)
+	if want := "/insecure/raw:1/fn:" + fn("chart.png") + ":1/plain/https://images.example.com/reports/q3/revenue-chart.png"; next.req.URL.Path != want {
+		t.Errorf("raw forwarded %s, want %s", next.req.URL.Path, want)
+	}
+}
+
+func TestAbsoluteRewrite(t *testing.T) {
+	jobs := [][]string{{"f", "catalogue/2025/spring #1.png"}, {"p", "thumb", "640x"}}
+	target := signedURL(t, testSecret, jobs, ".png") + "&v=3"
+	const path = "/insecure/rs:fit:640:0/ar:1/plain/https://images.example.com/catalogue/2025/spring%20%231.png"
+	passthrough := func(config *Config) { config.PassthroughParams = []string{"v"} }
+
+	// relative, the default: only the path and query change
+	handler, next := newTestHandler(t, passthrough)
+	serve(handler, target, nil)
+	if next.req.URL.IsAbs() || next.req.Host != "example.com" || next.req.RequestURI != path+"?v=3" {
+		t.Errorf("relative rewrite %q, host %q, RequestURI %q", next.req.URL, next.req.Host, next.req.RequestURI)
+	}
+
+	for baseURL, want := range map[string]string{
+		"http://imgproxy:8080":                 "http://imgproxy:8080" + path + "?v=3",
+		"https://img.example.net/resize/":      "https://img.example.net/resize" + path + "?v=3",
+		"https://img.example.net/a%20b/resize": "https://img.example.net/a%20b/resize" + path + "?v=3",
+	} {
+		handler, next := newTestHandler(t, func(config *Config) {
+			passthrough(config)
+			config.AbsoluteRewrite = true
+			config.ImgproxyBaseURL = baseURL
+		})
+		if rw := serve(handler, target, nil); rw.Code != http.StatusOK {
+			t.Fatalf("%s: status %d, body %q", baseURL, rw.Code, rw.Body.String())
+		}
+		if got := next.req.URL.String(); got != want || next.req.RequestURI != want {
+			t.Errorf("%s: url %s, RequestURI %s, want %s", baseURL, got, next.req.RequestURI, want)
+		}
+		if base, _ := url.Parse(want); next.req.Host != base.Host {
+			t.Errorf("%s: Host %q", baseURL, next.req.Host)
+		}
+	}
+
+	for _, baseURL := range []string{"", "imgproxy:8080/", "//imgproxy:8080"} {
+		config := testConfig()
+		config.AbsoluteRewrite = true
+		config.ImgproxyBaseURL = baseURL
+		if _, err := New(context.Background(), &nextHandler{}, config, "test"); err == nil {
+			t.Errorf("AbsoluteRewrite accepted ImgproxyBaseURL %q", baseURL)
+		}
+	}
+}
+
+func TestPageParameter(t *testing.T) {
+	brochure := signedURL(t, testSecret, [][]string{{"f", "sales/brochures/2026-lineup.pdf"}, {"p", "thumb", "800x"}}, "")
+	handler, next := newTestHandler(t, func(config *Config) { config.PassthroughParams = []string{"page", "v"} })
+	forwarded := func(option string) string {
+		return "/insecure/rs:fit:800:0/ar:1/" + option + "plain/https://images.example.com/sales/brochures/2026-lineup.pdf"
+	}
+
+	steps := []struct {
+		query  string
+		status int
+		want   string
+	}{
+		{"", http.StatusOK, forwarded("")},
+		{"&page=0", http.StatusOK, forwarded("pg:0/")},
+		{"&page=3", http.StatusOK, forwarded("pg:3/")},
+		{"&page=007", http.StatusOK, forwarded("pg:7/")},
+		{"&page=-1", http.StatusBadRequest, ""},
+		{"&page=2.5", http.StatusBadRequest, ""},
+		{"&page=last", http.StatusBadRequest, ""},
+		{"&page=99999999999999999999", http.StatusBadRequest, ""},
+	}
+	for _, step := range steps {
+		next.called = false
+		rw := serve(handler, brochure+step.query, nil)
+		if rw.Code != step.status || next.called != (step.status == http.StatusOK) {
+			t.Errorf("%q: status %d, want %d", step.query, rw.Code, step.status)
+			continue
+		}
+		if next.called && (next.req.URL.Path != step.want || next.req.URL.Query().Has("page")) {
+			t.Errorf("%q: forwarded %s?%s, want %s", step.query, next.req.URL.Path, next.req.URL.RawQuery, step.want)
+		}
+	}
+
+	// a page is processing, raw mode can't return it
+	raw, next := newTestHandler(t, func(config *Config) { config.PassOriginalWhenNoProcessing = true })
+	serve(raw, signedURL(t, testSecret, [][]string{{"f", "sales/brochures/2026-lineup.pdf"}}, "")+"&page=2", nil)
+	if want := "/insecure/ar:1/pg:2/plain/https://images.example.com/sales/brochures/2026-lineup.pdf"; next.req.URL.Path != want {
+		t.Errorf("raw mode forwarded %s, want %s", next.req.URL.Path, want)
+	}
+}